@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func setBufferLines(_ int) error {
+	return errors.New("setting the console buffer size is only supported on Windows")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+)
+
+var (
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+	procSetConsoleScreenBufferSize = kernel32.NewProc("SetConsoleScreenBufferSize")
+)
+
+type coord struct {
+	X, Y int16
+}
+
+type consoleScreenBufferInfo struct {
+	Size              coord
+	CursorPosition    coord
+	Attributes        uint16
+	Window            struct{ Left, Top, Right, Bottom int16 }
+	MaximumWindowSize coord
+}
+
+// setBufferLines sets the height of the console screen buffer behind stdout
+// to lines, keeping its width.
+func setBufferLines(lines int) error {
+	h := os.Stdout.Fd()
+	var info consoleScreenBufferInfo
+	if r, _, err := procGetConsoleScreenBufferInfo.Call(h, uintptr(unsafe.Pointer(&info))); r == 0 {
+		return err
+	}
+	// The COORD argument is passed by value, packed into one register.
+	size := uintptr(uint16(info.Size.X)) | uintptr(uint16(lines))<<16
+	if r, _, err := procSetConsoleScreenBufferSize.Call(h, size); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func clearScreen() error {
+	_, err := fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J\x1b[3J")
+	return err
+}
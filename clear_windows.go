@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func clearScreen() error {
+	cmd := exec.Command("cmd.exe", "/c", "cls")
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
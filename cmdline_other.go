@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// rawCommandLine returns "": other platforms pass arguments as a list, so
+// there is no unsplit command line.
+func rawCommandLine() string {
+	return ""
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// rawCommandLine returns the launcher's command line as Windows passed it,
+// before any argument splitting.
+func rawCommandLine() string {
+	p := syscall.GetCommandLine()
+	var units []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Add(ptr, 2) {
+		units = append(units, *(*uint16)(ptr))
+	}
+	return string(utf16.Decode(units))
+}
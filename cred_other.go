@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func readCredential(_ string) (string, error) {
+	return "", errors.New("Credential Manager is only supported on Windows")
+}
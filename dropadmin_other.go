@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func dropAdmin(_ *exec.Cmd) error {
+	return errors.New("dropping administrator rights is only supported on Windows")
+}
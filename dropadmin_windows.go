@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procSaferCreateLevel           = advapi32.NewProc("SaferCreateLevel")
+	procSaferComputeTokenFromLevel = advapi32.NewProc("SaferComputeTokenFromLevel")
+	procSaferCloseLevel            = advapi32.NewProc("SaferCloseLevel")
+	procSetTokenInformation        = advapi32.NewProc("SetTokenInformation")
+)
+
+const (
+	saferScopeIDUser        = 2
+	saferLevelIDNormalUser  = 0x20000
+	saferLevelOpen          = 1
+	tokenIntegrityLevel     = 25
+	seGroupIntegrity        = 0x20
+	mediumIntegrityLevelSID = "S-1-16-8192"
+)
+
+type tokenMandatoryLabel struct {
+	Label syscall.SIDAndAttributes
+}
+
+// dropAdmin makes cmd start with a normal-user token at medium integrity,
+// derived from the launcher's own token, so an elevated launcher starts a
+// non-elevated shell.
+func dropAdmin(cmd *exec.Cmd) error {
+	var level uintptr
+	if r, _, err := procSaferCreateLevel.Call(saferScopeIDUser, saferLevelIDNormalUser, saferLevelOpen,
+		uintptr(unsafe.Pointer(&level)), 0); r == 0 {
+		return err
+	}
+	defer procSaferCloseLevel.Call(level)
+
+	var token syscall.Token
+	if r, _, err := procSaferComputeTokenFromLevel.Call(level, 0, uintptr(unsafe.Pointer(&token)), 0, 0); r == 0 {
+		return err
+	}
+
+	sid, err := syscall.StringToSid(mediumIntegrityLevelSID)
+	if err != nil {
+		_ = token.Close()
+		return err
+	}
+	label := tokenMandatoryLabel{Label: syscall.SIDAndAttributes{Sid: sid, Attributes: seGroupIntegrity}}
+	if r, _, err := procSetTokenInformation.Call(uintptr(token), tokenIntegrityLevel,
+		uintptr(unsafe.Pointer(&label)), unsafe.Sizeof(label)+uintptr(sid.Len())); r == 0 {
+		_ = token.Close()
+		return err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Token = token
+	return nil
+}
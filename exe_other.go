@@ -0,0 +1,7 @@
+//go:build !windows
+
+package main
+
+// exeSuffix is empty off Windows so that the launcher logic can be
+// exercised against a plain "bash" on other platforms.
+const exeSuffix = ""
@@ -0,0 +1,4 @@
+package main
+
+// exeSuffix is appended to program names looked up under the MSYS2 root.
+const exeSuffix = ".exe"
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// hostCommand returns a command that runs command through /bin/sh.
+func hostCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"cmp"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// hostCommand returns a command that runs command through cmd.exe. The
+// command line is passed verbatim so that cmd.exe sees it as typed.
+func hostCommand(command string) *exec.Cmd {
+	comspec := cmp.Or(os.Getenv("ComSpec"), "cmd.exe")
+	cmd := exec.Command(comspec)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: windowsQuoteArg(comspec) + ` /d /s /c "` + command + `"`,
+	}
+	return cmd
+}
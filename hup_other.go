@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// hangUp sends SIGHUP to the shell process p.
+func hangUp(p *os.Process, _ string) error {
+	return p.Signal(syscall.SIGHUP)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// hangUp delivers SIGHUP to the shell process p. Windows has no such
+// signal, so the MSYS2 runtime's kill.exe from msysRoot raises it inside the
+// shell, addressing the process by its Windows PID.
+func hangUp(p *os.Process, msysRoot string) error {
+	kill := filepath.Join(msysRoot, "usr", "bin", "kill.exe")
+	cmd := exec.Command(kill, "-HUP", "-W", strconv.Itoa(p.Pid))
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: 0x08000000} // CREATE_NO_WINDOW
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %w: %s", kill, err, msg)
+		}
+		return fmt.Errorf("%s: %w", kill, err)
+	}
+	return nil
+}
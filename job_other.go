@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func enterJob() error {
+	return errors.New("job objects are only supported on Windows")
+}
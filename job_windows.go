@@ -0,0 +1,76 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+)
+
+const (
+	jobObjectExtendedLimitInfoClass = 9
+	jobObjectLimitKillOnJobClose    = 0x00002000
+)
+
+type jobObjectBasicLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+type ioCounters struct {
+	ReadOperationCount  uint64
+	WriteOperationCount uint64
+	OtherOperationCount uint64
+	ReadTransferCount   uint64
+	WriteTransferCount  uint64
+	OtherTransferCount  uint64
+}
+
+type jobObjectExtendedLimitInformation struct {
+	BasicLimitInformation jobObjectBasicLimitInformation
+	IoInfo                ioCounters
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// enterJob places the launcher in a new job object that kills every member
+// when its last handle closes. Children inherit the job, so the whole shell
+// process tree ends with the launcher. The handle is intentionally never
+// closed.
+func enterJob() error {
+	job, _, err := procCreateJobObjectW.Call(0, 0)
+	if job == 0 {
+		return err
+	}
+
+	var info jobObjectExtendedLimitInformation
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose
+	if r, _, err := procSetInformationJobObject.Call(job, jobObjectExtendedLimitInfoClass,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); r == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+
+	self, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if r, _, err := procAssignProcessToJobObject.Call(job, uintptr(self)); r == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+package main
+
+import "syscall"
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// longPathsEnabled reports true: path length limits are a Windows concern.
+func longPathsEnabled() (bool, error) {
+	return true, nil
+}
+
+func enableLongPaths() error {
+	return errors.New("enabling long paths is only supported on Windows")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var procRegSetValueExW = advapi32.NewProc("RegSetValueExW")
+
+const (
+	fileSystemKey  = `SYSTEM\CurrentControlSet\Control\FileSystem`
+	longPathsValue = "LongPathsEnabled"
+)
+
+// longPathsEnabled reports whether Windows long path support is turned on
+// in the registry.
+func longPathsEnabled() (bool, error) {
+	key, err := openFileSystemKey(syscall.KEY_QUERY_VALUE)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.RegCloseKey(key)
+
+	var value, typ uint32
+	size := uint32(unsafe.Sizeof(value))
+	err = syscall.RegQueryValueEx(key, syscall.StringToUTF16Ptr(longPathsValue), nil, &typ,
+		(*byte)(unsafe.Pointer(&value)), &size)
+	if err == syscall.ERROR_FILE_NOT_FOUND {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return typ == syscall.REG_DWORD && value == 1, nil
+}
+
+// enableLongPaths turns on Windows long path support, which needs
+// administrator rights.
+func enableLongPaths() error {
+	key, err := openFileSystemKey(syscall.KEY_SET_VALUE)
+	if err == syscall.ERROR_ACCESS_DENIED {
+		return fmt.Errorf("%w (run as administrator)", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer syscall.RegCloseKey(key)
+
+	value := uint32(1)
+	if r, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(longPathsValue))),
+		0, syscall.REG_DWORD, uintptr(unsafe.Pointer(&value)), unsafe.Sizeof(value)); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+func openFileSystemKey(access uint32) (syscall.Handle, error) {
+	var key syscall.Handle
+	err := syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, syscall.StringToUTF16Ptr(fileSystemKey), 0, access, &key)
+	return key, err
+}
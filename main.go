@@ -1,15 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 type Config struct {
@@ -20,22 +40,297 @@ type Config struct {
 	Wd          string
 	WinSymlinks bool
 	UseHome     bool
+
+	ShellFromPasswd bool
+	Priority        string
+	SaveConfig      string
+	SaveConfigOnly  bool
+	ExecNameMap     map[string]string
+
+	ExitHook          bool
+	ExitHookThreshold time.Duration
+
+	ConfigPaths  []string
+	ConfigFormat string
+
+	NoMotd      bool
+	IdleTimeout time.Duration
+	Restricted  bool
+	Title       string
+
+	DefaultShellArgs []string
+	IgnoreConfig     bool
+
+	SSHAgent    bool
+	SSHAuthSock string
+	Clear       bool
+	Tmux        string
+
+	NoStdin  bool
+	NoStdout bool
+	NoStderr bool
+
+	InheritMsys bool
+	Shortcut    bool
+
+	LauncherExitCode int
+
+	RestartOnExit   bool
+	MaxRestarts     int
+	RestartBackoff  time.Duration
+	RestartStopCode int
+
+	Job       bool
+	PickShell bool
+	LogFile   string
+
+	PrintCmdline  bool
+	DropAdmin     bool
+	ListInstalled bool
+	ListShells    bool
+
+	PreCommand             string
+	PreCommandIgnoreErrors bool
+	SuccessCodes           []int
+	CaptureEnv             string
+	OutputEncoding         string
+	SysconfDir             string
+	Analytics              string
+	WaitForPath            string
+	WaitTimeout            time.Duration
+	ExportCmdline          bool
+	AuditLog               string
+
+	DumpDefaultConfig bool
+	ExpectVersion     string
+
+	Unset []string
+	Guard bool
+
+	Script    bool
+	ErrExit   bool
+	LoginMode string
+
+	WriteEnv     string
+	WriteEnvOnly bool
+
+	DotfilesDir  string
+	WarnMultiple bool
+
+	NoSignalHandling bool
+
+	OpenRoot bool
+	OpenHome bool
+
+	WarnPathShadowing bool
+
+	EnvModule  string
+	EnvModules map[string]string
+	Aliases    map[string][]string
+
+	MaxPathWarn int
+
+	HistoryFile     string
+	HistoryTemplate string
+
+	AssertOutput string
+	AssertRegex  string
+
+	Record string
+	Replay string
+
+	Probe bool
+
+	Wrapper     string
+	WrapperArgs []string
+
+	EnableLongPaths bool
+
+	ExtraEnv []string
+
+	EnableVT bool
+	ViaWT    bool
+
+	ValidateConfig bool
+	Prompt         string
+	Capabilities   bool
+	AsFlags        bool
+	BufferLines    int
+
+	Creds []string
+
+	HupOnExit bool
+
+	Mounts         []string
+	CygdrivePrefix string
+
+	Setup        bool
+	ProgressJSON bool
+	PruneEnv     bool
+	HomeWindows  bool
+	NoPathConv   bool
+	PSWrapper    bool
+	ShellSHA256  string
+	KeepMsysEnv  bool
+
+	// MsysRoots are candidates for MsysRoot from a config file; the first
+	// one containing usr/bin/bash is used.
+	MsysRoots []string
+
+	Lang       string
+	LcAll      string
+	UTF8Locale bool
+	DefaultDir string
+
+	MirrorMsys  string
+	MirrorMingw string
+}
+
+// jsonConfig is the on-disk form of the persistent Config fields.
+type jsonConfig struct {
+	LoginShell  string       `json:"loginShell,omitempty"`
+	PathType    string       `json:"pathType,omitempty"`
+	MsysRoot    stringOrList `json:"msysRoot,omitempty"`
+	MSystem     string       `json:"msystem,omitempty"`
+	WinSymlinks bool         `json:"winSymlinks,omitempty"`
+
+	ShellFromPasswd bool              `json:"shellFromPasswd,omitempty"`
+	ExecNameMap     map[string]string `json:"execNameMap,omitempty"`
+
+	DefaultShellArgs []string `json:"defaultShellArgs,omitempty"`
+	SSHAuthSock      string   `json:"sshAuthSock,omitempty"`
+	DefaultDir       string   `json:"defaultDir,omitempty"`
+	LoginMode        string   `json:"loginMode,omitempty"`
+	ShellSHA256      string   `json:"shellSha256,omitempty"`
+	Analytics        string   `json:"analytics,omitempty"`
+
+	EnvModules map[string]string   `json:"envModules,omitempty"`
+	Aliases    map[string][]string `json:"aliases,omitempty"`
+	Env        []string            `json:"env,omitempty"`
+
+	Overrides []jsonOverride `json:"overrides,omitempty"`
+}
+
+// jsonOverride is a config patch applied only on matching machines.
+type jsonOverride struct {
+	When struct {
+		Hostname string `json:"hostname,omitempty"`
+		User     string `json:"user,omitempty"`
+	} `json:"when"`
+	Config jsonConfig `json:"config"`
+}
+
+// matches reports whether every condition set in o.When holds; both are
+// compared case-insensitively.
+func (o jsonOverride) matches(hostname, user string) bool {
+	if o.When.Hostname != "" && !strings.EqualFold(o.When.Hostname, hostname) {
+		return false
+	}
+	if o.When.User != "" && !strings.EqualFold(o.When.User, user) {
+		return false
+	}
+	return true
 }
 
 type Spec struct {
 	Cfg       Config
 	ShellArgs []string
+	// Args are the shell arguments given after "--", before options such as
+	// -tmux or -script turned them into ShellArgs.
+	Args     []string `json:",omitempty"`
+	Launcher string
+	// Env replaces the environment computed from Cfg; it is only set for
+	// launches replayed with -replay.
+	Env []string `json:",omitempty"`
 }
 
+// Errors reported by the launcher; wrapped with context so that callers can
+// match them with errors.Is.
+var (
+	ErrConfigNotFound  = errors.New("config file not found")
+	ErrInvalidMSystem  = errors.New("unsupported MSYSTEM")
+	ErrShellNotFound   = errors.New("shell not found")
+	ErrStatTimeout     = errors.New("timed out")
+	ErrInvalidPathType = errors.New("invalid path type")
+)
+
+const defaultLoginShell = "bash"
+
+const defaultExitHookThreshold = 2 * time.Second
+
+const defaultTmuxSession = "main"
+
+const defaultMaxPathWarn = 240
+
+const defaultWaitTimeout = 30 * time.Second
+
+// statTimeout bounds checks of paths under msysRoot, which can block for a
+// long time when it is on an unreachable network drive.
+const statTimeout = 5 * time.Second
+
+// probeTimeout bounds the test command run by -probe, so that a profile
+// waiting for input cannot hang the probe.
+const probeTimeout = 30 * time.Second
+
 var validPathTypes = map[string]bool{
 	"minimal": true,
 	"strict":  true,
 	"inherit": true,
 }
 
+// configFormats lists the config file formats understood by this build,
+// keyed by name and mapped to the file extensions that select them.
+var configFormats = map[string][]string{
+	"json": {".json"},
+}
+
+// msystemPrefixes maps each MSYSTEM to its prefix directory under the
+// MSYS2 root and the GOARCH of the programs installed there, in display
+// order. MSYS has no Arch since it follows the installation itself.
+var msystemPrefixes = []struct {
+	MSystem string
+	Prefix  string
+	Arch    string
+}{
+	{"MSYS", "usr", ""},
+	{"UCRT64", "ucrt64", "amd64"},
+	{"CLANG64", "clang64", "amd64"},
+	{"CLANGARM64", "clangarm64", "arm64"},
+	{"MINGW64", "mingw64", "amd64"},
+	{"MINGW32", "mingw32", "386"},
+}
+
+var validPriorities = map[string]bool{
+	"idle":   true,
+	"below":  true,
+	"normal": true,
+	"above":  true,
+	"high":   true,
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// version is the launcher version, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// launcherExitCode is the exit status for launcher-originated failures,
+// set with -launcher-exit-code to tell them apart from shell exit codes.
+var launcherExitCode = 1
+
+// diagOut receives the launcher's warnings; see -log-file.
+var diagOut io.Writer = os.Stderr
+
+func warn(err error) {
+	_, _ = fmt.Fprintln(diagOut, "warning:", err)
+}
+
 func fatal(err error) {
 	_, _ = fmt.Fprintln(os.Stderr, err)
-	os.Exit(1)
+	os.Exit(launcherExitCode)
 }
 
 func getMSystemFromName(name string) string {
@@ -47,230 +342,3508 @@ func getMSystemFromName(name string) string {
 		"CLANGARM64": "CLANGARM64",
 		"MSYS":       "MSYS",
 		"MSYS2":      "MSYS",
+
+		// Short and historical aliases.
+		"MINGW":    "MINGW64",
+		"UCRT":     "UCRT64",
+		"CLANG":    "CLANG64",
+		"CLANGARM": "CLANGARM64",
 	}
 	return m[strings.ToUpper(name)]
 }
 
-func getMSystemFromExecName(execName string) string {
+// getMSystemFromExecName consults the custom map (matched
+// case-insensitively) before the built-in names.
+func getMSystemFromExecName(execName string, custom map[string]string) string {
 	base := strings.TrimSuffix(execName, filepath.Ext(execName))
+	for name, msystem := range custom {
+		if !strings.EqualFold(name, base) {
+			continue
+		}
+		v := getMSystemFromName(msystem)
+		if v == "" {
+			fatal(fmt.Errorf("%w in execNameMap: %s", ErrInvalidMSystem, msystem))
+		}
+		return v
+	}
 	return getMSystemFromName(base)
 }
 
-func loadJSONConfig(path string) Config {
-	cfg := Config{
-		LoginShell: "bash",
-		PathType:   "minimal",
+// configFormat returns the parser to use for path: forced when set, else the
+// one matching the file extension, defaulting to json.
+func configFormat(path, forced string) string {
+	if forced != "" {
+		f := strings.ToLower(forced)
+		if _, ok := configFormats[f]; !ok {
+			fatal(fmt.Errorf("unsupported config format '%s' (supported: %s)", forced, strings.Join(supportedConfigFormats(), ", ")))
+		}
+		return f
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for f, exts := range configFormats {
+		if slices.Contains(exts, ext) {
+			return f
+		}
+	}
+	return "json"
+}
+
+func supportedConfigFormats() []string {
+	names := make([]string, 0, len(configFormats))
+	for f := range configFormats {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadConfig(path, format string) Config {
+	switch f := configFormat(path, format); f {
+	case "json":
+		return loadJSONConfig(path)
+	default:
+		fatal(fmt.Errorf("unsupported config format '%s'", f))
+		return Config{}
+	}
+}
+
+// Resolver loads config files and keeps each parsed document, reusing it
+// until the file's modification time or size changes, so that a process
+// resolving many launches reads every file once. ${VAR} references and
+// per-machine overrides are applied on every lookup, so that changes to the
+// environment take effect without touching the file. The zero value is
+// ready to use and safe for concurrent use.
+type Resolver struct {
+	mu       sync.Mutex
+	defaults *jsonConfig
+	files    map[[2]string]cachedConfig
+}
+
+type cachedConfig struct {
+	modTime time.Time
+	size    int64
+	doc     jsonConfig
+}
+
+// configs is the Resolver shared by the lookups of a launch.
+var configs Resolver
+
+// Defaults returns the built-in defaults, parsed on first use.
+func (r *Resolver) Defaults() Config {
+	r.mu.Lock()
+	if r.defaults == nil {
+		doc := parseJSONConfig(defaultConfigJSON)
+		r.defaults = &doc
+	}
+	doc := *r.defaults
+	r.mu.Unlock()
+	return applyJSONConfig(Config{}, doc)
+}
+
+// Load returns the settings from the config file path like loadConfig,
+// parsing the file again only when it changed since the last call.
+func (r *Resolver) Load(path, format string) Config {
+	fi, err := os.Stat(path)
+	if err != nil || configFormat(path, format) != "json" {
+		return loadConfig(path, format)
+	}
+
+	key := [2]string{path, format}
+	r.mu.Lock()
+	c, ok := r.files[key]
+	r.mu.Unlock()
+	if !ok || !c.modTime.Equal(fi.ModTime()) || c.size != fi.Size() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fatal(fmt.Errorf("read config file failed: %w", err))
+		}
+		c = cachedConfig{modTime: fi.ModTime(), size: fi.Size(), doc: parseJSONConfig(data)}
+		r.mu.Lock()
+		if r.files == nil {
+			r.files = make(map[[2]string]cachedConfig)
+		}
+		r.files[key] = c
+		r.mu.Unlock()
+	}
+	return applyJSONConfig(Config{}, c.doc)
+}
+
+// Resolve merges the settings for a launch with the command-line flags cli:
+// the built-in defaults, then the config files given with -config, or
+// defaultPath without them, then the MSYS2_SHELL_* variables, then cli.
+// With -ignore-config only the defaults and cli are used.
+func (r *Resolver) Resolve(cli Config, defaultPath string) Config {
+	sources := []Config{r.Defaults()}
+	if !cli.IgnoreConfig {
+		paths := cli.ConfigPaths
+		if len(paths) == 0 {
+			paths = []string{defaultPath}
+		}
+		for _, p := range paths {
+			sources = append(sources, r.Load(p, cli.ConfigFormat))
+		}
+		sources = append(sources, loadEnvConfig())
+	}
+	return resolveConfig(append(sources, cli))
+}
+
+// defaultConfigJSON holds the built-in defaults, applied before any config
+// file. Edit default_config.json before building to ship a launcher that
+// works without an external file.
+//
+//go:embed default_config.json
+var defaultConfigJSON []byte
+
+func defaultConfig() Config {
+	return mergeJSONConfig(Config{}, defaultConfigJSON)
+}
+
+// expandConfigVars replaces ${VAR} in s with the value of the environment
+// variable VAR; "$$" yields a literal "$". Undefined variables expand to
+// the empty string with a warning.
+func expandConfigVars(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				break
+			}
+			name := s[i+2 : i+2+end]
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				warn(fmt.Errorf("config references undefined variable %s", name))
+			}
+			b.WriteString(v)
+			i += 2 + end
+			continue
+		}
+		b.WriteByte('$')
 	}
+	return b.String()
+}
 
+// loadJSONConfig returns the settings from path, without defaults. A
+// missing file yields an empty Config.
+func loadJSONConfig(path string) Config {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return cfg
+			return Config{}
 		}
 		fatal(fmt.Errorf("read config file failed: %w", err))
 	}
+	return mergeJSONConfig(Config{}, data)
+}
 
-	var tmp struct {
-		LoginShell  string `json:"loginShell,omitempty"`
-		PathType    string `json:"pathType,omitempty"`
-		MsysRoot    string `json:"msysRoot,omitempty"`
-		WinSymlinks bool   `json:"winSymlinks,omitempty"`
-	}
+// mergeJSONConfig merges the JSON document data, including its matching
+// overrides, onto cfg.
+func mergeJSONConfig(cfg Config, data []byte) Config {
+	return applyJSONConfig(cfg, parseJSONConfig(data))
+}
 
+// parseJSONConfig decodes the JSON document data without expanding it.
+func parseJSONConfig(data []byte) jsonConfig {
+	var tmp jsonConfig
 	if err := json.Unmarshal(data, &tmp); err != nil {
 		fatal(fmt.Errorf("parse json config failed: %w", err))
 	}
+	return tmp
+}
 
-	if tmp.LoginShell != "" {
-		cfg.LoginShell = tmp.LoginShell
-	}
-	if tmp.PathType != "" {
-		cfg.PathType = tmp.PathType
+// applyJSONConfig merges the parsed document tmp, including its matching
+// overrides, onto cfg. tmp itself is left unchanged.
+func applyJSONConfig(cfg Config, tmp jsonConfig) Config {
+	cfg = mergeConfig(cfg, fromJSONConfig(tmp))
+
+	if len(tmp.Overrides) > 0 {
+		hostname, _ := os.Hostname()
+		user := os.Getenv("USERNAME")
+		for _, o := range tmp.Overrides {
+			if o.matches(hostname, user) {
+				cfg = mergeConfig(cfg, fromJSONConfig(o.Config))
+			}
+		}
 	}
-	cfg.MsysRoot = tmp.MsysRoot
-	cfg.WinSymlinks = tmp.WinSymlinks
 	return cfg
 }
 
-func splitOSArgs() ([]string, []string) {
-	args := os.Args[1:]
-	for i, a := range args {
-		if a == "--" {
-			return args[:i], args[i+1:]
-		}
+// expandConfigList applies expandConfigVars to each element of l.
+func expandConfigList(l []string) []string {
+	if l == nil {
+		return nil
 	}
-	return args, nil
+	out := make([]string, len(l))
+	for i, v := range l {
+		out[i] = expandConfigVars(v)
+	}
+	return out
 }
 
-func parseLauncherFlags(launcherArgs []string) Config {
-	var cfg Config
-	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-
-	fs.StringVar(&cfg.MsysRoot, "msysroot", "", "MSYS2 root path")
-	fs.StringVar(&cfg.LoginShell, "shell", "", "login shell")
-	fs.StringVar(&cfg.PathType, "pathtype", "", "MSYS2_PATH_TYPE (minimal, strict, inherit)")
-	fs.StringVar(&cfg.MSystem, "msystem", "", "MSYSTEM (if not inferred from executable name)")
-	fs.StringVar(&cfg.Wd, "wd", "", "working directory; not with -home")
-	fs.BoolVar(&cfg.UseHome, "home", false, "start in home directory; not with -wd")
-	fs.BoolVar(&cfg.WinSymlinks, "winsymlinks", false, "enable winsymlinks")
+// expandConfigMap applies expandConfigVars to each value of m.
+func expandConfigMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = expandConfigVars(v)
+	}
+	return out
+}
 
-	if err := fs.Parse(launcherArgs); err != nil {
-		fatal(err)
+// fromJSONConfig converts tmp, expanding ${VAR} references in every string
+// it holds, including list elements and map values.
+func fromJSONConfig(tmp jsonConfig) Config {
+	for _, f := range []*string{&tmp.LoginShell, &tmp.PathType, &tmp.MSystem, &tmp.SSHAuthSock,
+		&tmp.DefaultDir, &tmp.LoginMode, &tmp.ShellSHA256, &tmp.Analytics} {
+		*f = expandConfigVars(*f)
+	}
+	tmp.DefaultShellArgs = expandConfigList(tmp.DefaultShellArgs)
+	tmp.Env = expandConfigList(tmp.Env)
+	tmp.ExecNameMap = expandConfigMap(tmp.ExecNameMap)
+	tmp.EnvModules = expandConfigMap(tmp.EnvModules)
+	if tmp.Aliases != nil {
+		aliases := make(map[string][]string, len(tmp.Aliases))
+		for name, args := range tmp.Aliases {
+			aliases[name] = expandConfigList(args)
+		}
+		tmp.Aliases = aliases
 	}
 
-	if fs.NArg() > 0 {
-		fs.Usage()
-		os.Exit(1)
+	var msysRoot string
+	var msysRoots []string
+	for _, r := range tmp.MsysRoot {
+		msysRoots = append(msysRoots, expandConfigVars(r))
+	}
+	if len(msysRoots) == 1 && msysRoots[0] != appendMarker {
+		msysRoot, msysRoots = msysRoots[0], nil
 	}
+	return Config{
+		LoginShell:       tmp.LoginShell,
+		PathType:         tmp.PathType,
+		MsysRoot:         msysRoot,
+		MsysRoots:        msysRoots,
+		MSystem:          tmp.MSystem,
+		WinSymlinks:      tmp.WinSymlinks,
+		ShellFromPasswd:  tmp.ShellFromPasswd,
+		ExecNameMap:      tmp.ExecNameMap,
+		DefaultShellArgs: tmp.DefaultShellArgs,
+		SSHAuthSock:      tmp.SSHAuthSock,
+		DefaultDir:       tmp.DefaultDir,
+		LoginMode:        tmp.LoginMode,
+		ShellSHA256:      tmp.ShellSHA256,
+		Analytics:        tmp.Analytics,
+		EnvModules:       tmp.EnvModules,
+		Aliases:          tmp.Aliases,
+		ExtraEnv:         tmp.Env,
+	}
+}
 
+// envConfigPrefix prefixes environment variables that mirror the JSON
+// fields, e.g. MSYS2_SHELL_MSYSROOT for msysRoot.
+const envConfigPrefix = "MSYS2_SHELL_"
+
+func loadEnvConfig() Config {
+	var cfg Config
+	cfg.LoginShell = os.Getenv(envConfigPrefix + "LOGINSHELL")
+	cfg.PathType = os.Getenv(envConfigPrefix + "PATHTYPE")
+	cfg.MsysRoot = os.Getenv(envConfigPrefix + "MSYSROOT")
+	cfg.WinSymlinks = envBool(envConfigPrefix + "WINSYMLINKS")
+	cfg.ShellFromPasswd = envBool(envConfigPrefix + "SHELLFROMPASSWD")
+	cfg.SSHAuthSock = os.Getenv(envConfigPrefix + "SSHAUTHSOCK")
+	cfg.DefaultDir = os.Getenv(envConfigPrefix + "DEFAULTDIR")
+	cfg.MSystem = os.Getenv(envConfigPrefix + "MSYSTEM")
+	cfg.ShellSHA256 = os.Getenv(envConfigPrefix + "SHELLSHA256")
+	cfg.Analytics = os.Getenv(envConfigPrefix + "ANALYTICS")
 	return cfg
 }
 
-func mergeConfig(base, cli Config) Config {
-	if cli.LoginShell != "" {
-		base.LoginShell = cli.LoginShell
+func envBool(key string) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return false
 	}
-	if cli.PathType != "" {
-		base.PathType = cli.PathType
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fatal(fmt.Errorf("invalid boolean in %s: '%s'", key, v))
 	}
-	if cli.MsysRoot != "" {
-		base.MsysRoot = cli.MsysRoot
+	return b
+}
+
+func saveJSONConfig(path string, cfg Config) {
+	tmp := jsonConfig{
+		LoginShell:      cfg.LoginShell,
+		PathType:        cfg.PathType,
+		MSystem:         cfg.MSystem,
+		WinSymlinks:     cfg.WinSymlinks,
+		ShellFromPasswd: cfg.ShellFromPasswd,
+		ExecNameMap:     cfg.ExecNameMap,
+
+		DefaultShellArgs: cfg.DefaultShellArgs,
+		SSHAuthSock:      cfg.SSHAuthSock,
+		DefaultDir:       cfg.DefaultDir,
+		LoginMode:        cfg.LoginMode,
+		ShellSHA256:      cfg.ShellSHA256,
+		Analytics:        cfg.Analytics,
+		EnvModules:       cfg.EnvModules,
+		Aliases:          cfg.Aliases,
+		Env:              cfg.ExtraEnv,
 	}
-	if cli.WinSymlinks {
-		base.WinSymlinks = true
+
+	if cfg.MsysRoot != "" {
+		tmp.MsysRoot = stringOrList{cfg.MsysRoot}
 	}
-	if cli.Wd != "" {
-		base.Wd = cli.Wd
+
+	data, err := json.MarshalIndent(tmp, "", "  ")
+	if err != nil {
+		fatal(fmt.Errorf("encode json config failed: %w", err))
 	}
-	if cli.MSystem != "" {
-		base.MSystem = cli.MSystem
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		fatal(fmt.Errorf("write config file failed: %w", err))
 	}
-	if cli.UseHome {
-		base.UseHome = true
+}
+
+func writeEnvFile(path string, env []string) {
+	data := strings.Join(env, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		fatal(fmt.Errorf("write env file failed: %w", err))
 	}
-	return base
 }
 
-func resolveMSystem(execName, cli string) string {
-	auto := getMSystemFromExecName(execName)
-	if auto != "" && cli != "" {
-		fatal(fmt.Errorf("conflict: exec name implies %s but -msystem flag provides %s", auto, cli))
+// recordSpec writes s together with its complete environment and working
+// directory to path for -replay. The file may contain secrets from the
+// environment, so it is only readable by the current user.
+func recordSpec(path string, s Spec) {
+	s.Cfg.Record = ""
+	if s.Cfg.Wd == "" {
+		s.Cfg.Wd, _ = os.Getwd()
 	}
-	if auto == "" && cli == "" {
-		fatal(errors.New("MSYSTEM not specified: rename exe or use -msystem flag"))
+	env, err := applyEnv(s.Cfg)
+	if err != nil {
+		fatal(err)
 	}
-	if cli != "" {
-		v := getMSystemFromName(cli)
-		if v == "" {
-			fatal(fmt.Errorf("unsupported MSYSTEM: %s", cli))
-		}
-		return v
+	s.Env = env
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		fatal(fmt.Errorf("encode launch record failed: %w", err))
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		fatal(fmt.Errorf("write launch record failed: %w", err))
 	}
-	return auto
 }
 
-func validatePathType(pt string) string {
-	lower := strings.ToLower(pt)
-	if !validPathTypes[lower] {
-		fatal(fmt.Errorf("invalid path type '%s'", pt))
+// loadSpec reads a launch recorded by recordSpec.
+func loadSpec(path string) Spec {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fatal(fmt.Errorf("read launch record failed: %w", err))
 	}
-	return lower
+	var s Spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		fatal(fmt.Errorf("parse launch record failed: %w", err))
+	}
+	if s.Env == nil {
+		fatal(fmt.Errorf("parse launch record failed: %s has no environment", path))
+	}
+	return s
 }
 
-func applyEnv(cfg Config) []string {
-	pt := validatePathType(cfg.PathType)
-	env := os.Environ()
+// expandAlias replaces a first argument of the form @name with the flags of
+// alias name. Arguments of the form @other inside an alias are expanded in
+// turn. args are returned unchanged if name is not an alias.
+func expandAlias(args []string, aliases map[string][]string) ([]string, error) {
+	name := strings.TrimPrefix(args[0], "@")
+	if _, ok := aliases[name]; !ok {
+		return args, nil
+	}
 
-	env = append(env, "MSYSTEM="+cfg.MSystem)
-	env = append(env, "CHERE_INVOKING=1")
-	env = append(env, "MSYS2_PATH_TYPE="+pt)
+	var expand func(name string, chain []string) ([]string, error)
+	expand = func(name string, chain []string) ([]string, error) {
+		chain = append(chain, name)
+		if slices.Contains(chain[:len(chain)-1], name) {
+			return nil, fmt.Errorf("alias cycle: %s", strings.Join(chain, " -> "))
+		}
+		var out []string
+		for _, a := range aliases[name] {
+			if other, ok := strings.CutPrefix(a, "@"); ok && aliases[other] != nil {
+				sub, err := expand(other, chain)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, sub...)
+				continue
+			}
+			out = append(out, a)
+		}
+		return out, nil
+	}
 
-	msysVal := ""
-	if cfg.WinSymlinks {
-		msysVal = "winsymlinks:nativestrict"
+	expanded, err := expand(name, nil)
+	if err != nil {
+		return nil, err
 	}
-	env = append(env, "MSYS="+msysVal)
-	return env
+	return append(expanded, args[1:]...), nil
 }
 
-func resolveSpec() Spec {
-	execPath, err := os.Executable()
+// expandResponseFile replaces a first argument of the form @path with the
+// arguments read from path. They are separated by whitespace, including
+// newlines; single or double quotes group text containing whitespace, and
+// backslashes are kept literally so that Windows paths need no escaping.
+func expandResponseFile(args []string) ([]string, error) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "@") {
+		return args, nil
+	}
+	data, err := os.ReadFile(args[0][1:])
 	if err != nil {
-		fatal(fmt.Errorf("failed to get launcher path: %w", err))
+		return nil, fmt.Errorf("read response file failed: %w", err)
 	}
-	execName := filepath.Base(execPath)
-
-	cfg := loadJSONConfig(filepath.Join(filepath.Dir(execPath), "msys2_shell.json"))
-	flags, rest := splitOSArgs()
-	cli := parseLauncherFlags(flags)
-	cfg = mergeConfig(cfg, cli)
 
-	if cfg.UseHome && cfg.Wd != "" {
-		fatal(errors.New("exclusive options: -home and -wd cannot be used together"))
+	var (
+		out     []string
+		cur     strings.Builder
+		inArg   bool
+		quote   rune
+		content = strings.TrimPrefix(string(data), "\ufeff")
+	)
+	for _, r := range content {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				out = append(out, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("invalid response file '%s': unterminated quote", args[0][1:])
 	}
+	if inArg {
+		out = append(out, cur.String())
+	}
+	return append(out, args[1:]...), nil
+}
 
-	if cfg.UseHome {
-		username := os.Getenv("USERNAME")
-		if username == "" {
-			fatal(errors.New("USERNAME not set"))
+// splitOSArgs splits args at the first "--" into launcher flags and shell
+// arguments.
+func splitOSArgs(args []string) ([]string, []string) {
+	for i, a := range args {
+		if a == "--" {
+			return args[:i], args[i+1:]
 		}
-		cfg.Wd = filepath.Join(cfg.MsysRoot, "home", username)
 	}
+	return args, nil
+}
 
-	cfg.MSystem = resolveMSystem(execName, cli.MSystem)
-	if cfg.MsysRoot == "" {
-		fatal(errors.New("missing configuration: msysRoot not specified"))
-	}
+// optionalString is a flag that can be given bare (-name) to select def, or
+// with a value (-name=value).
+type optionalString struct {
+	value *string
+	def   string
+}
 
-	if rest == nil {
-		rest = []string{}
+func (o optionalString) String() string {
+	if o.value == nil {
+		return ""
 	}
-	return Spec{Cfg: cfg, ShellArgs: rest}
+	return *o.value
 }
 
-func buildCmd(s Spec) *exec.Cmd {
-	shellExe := s.Cfg.LoginShell
-	if !strings.HasSuffix(strings.ToLower(shellExe), ".exe") {
-		shellExe += ".exe"
+func (o optionalString) Set(v string) error {
+	switch v {
+	case "true":
+		v = o.def
+	case "false":
+		v = ""
 	}
+	*o.value = v
+	return nil
+}
 
-	shellPath := filepath.Join(s.Cfg.MsysRoot, "usr", "bin", shellExe)
-	if _, err := os.Stat(shellPath); err != nil {
-		fatal(fmt.Errorf("shell not found at %s: %w", shellPath, err))
-	}
+func (o optionalString) IsBoolFlag() bool { return true }
 
-	dir := s.Cfg.Wd
-	if dir == "" {
-		dir, _ = os.Getwd()
-	}
+// stringOrList is a JSON value given either as a string or as an array of
+// strings. A single string is written back in the string form.
+type stringOrList []string
 
-	cmd := exec.Command(shellPath, append([]string{"-l"}, s.ShellArgs...)...)
-	cmd.Dir = dir
-	cmd.Env = applyEnv(s.Cfg)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd
+func (l *stringOrList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = stringOrList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("expected a string or an array of strings")
+	}
+	*l = list
+	return nil
 }
 
-func runCmd(cmd *exec.Cmd) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan)
-	go func() {
-		for range sigChan {
-		}
-	}()
-
-	err := cmd.Run()
-	if err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) {
-			os.Exit(exitErr.ExitCode())
-		}
-		fatal(fmt.Errorf("shell execution failed: %w", err))
+func (l stringOrList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
 	}
+	return json.Marshal([]string(l))
 }
 
-func main() {
-	runCmd(buildCmd(resolveSpec()))
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// codeList is a flag holding comma-separated exit codes.
+type codeList []int
+
+func (l *codeList) String() string {
+	var parts []string
+	for _, c := range *l {
+		parts = append(parts, strconv.Itoa(c))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *codeList) Set(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		c, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("invalid exit code '%s'", part)
+		}
+		*l = append(*l, c)
+	}
+	return nil
+}
+
+// errUnexpectedArgs reports positional arguments before "--".
+var errUnexpectedArgs = errors.New("unexpected arguments")
+
+// parseExitCode returns the exit status for an error from
+// parseLauncherFlags: 0 when -h was requested, and otherwise code, the
+// -launcher-exit-code value parsed before the error, or without one 1 for
+// unexpected arguments and 2 for invalid flags.
+func parseExitCode(err error, code int) int {
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case code > 0 && code <= 255:
+		return code
+	case errors.Is(err, errUnexpectedArgs):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// platformFlags maps the flags that only work on some platforms to those
+// platforms and whether this build is one of them. newLauncherFlags adds
+// this to their usage text, so that help shows what works here.
+var platformFlags = map[string]struct {
+	Platforms string
+	Available bool
+}{
+	"buffer-lines":      {"Windows", runtime.GOOS == "windows"},
+	"cred":              {"Windows", runtime.GOOS == "windows"},
+	"drop-admin":        {"Windows", runtime.GOOS == "windows"},
+	"enable-long-paths": {"Windows", runtime.GOOS == "windows"},
+	"enable-vt":         {"Windows", runtime.GOOS == "windows"},
+	"job":               {"Windows", runtime.GOOS == "windows"},
+	"open-home":         {"Windows", runtime.GOOS == "windows"},
+	"open-root":         {"Windows", runtime.GOOS == "windows"},
+	"priority":          {"Windows and Unix", prioritySupported},
+	"via-wt":            {"Windows", runtime.GOOS == "windows"},
+}
+
+// newLauncherFlags returns the launcher's flag set, storing values in cfg.
+func newLauncherFlags(name string, cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.Var((*stringList)(&cfg.ConfigPaths), "config", "read configuration from `path` instead of msys2_shell.json (repeatable, merged in order)")
+	fs.StringVar(&cfg.ConfigFormat, "config-format", "", "config file format, overriding detection by extension (json)")
+	fs.BoolVar(&cfg.IgnoreConfig, "ignore-config", false, "use only built-in defaults and flags; not with -config")
+	fs.StringVar(&cfg.MsysRoot, "msysroot", "", "MSYS2 root path")
+	fs.StringVar(&cfg.LoginShell, "shell", "", "login shell")
+	fs.StringVar(&cfg.PathType, "pathtype", "", "MSYS2_PATH_TYPE (minimal, strict, inherit)")
+	fs.StringVar(&cfg.MSystem, "msystem", "", "MSYSTEM (if not inferred from executable name)")
+	fs.StringVar(&cfg.Wd, "wd", "", "working directory; not with -home")
+	fs.BoolVar(&cfg.UseHome, "home", false, "start in home directory; not with -wd")
+	fs.BoolVar(&cfg.WinSymlinks, "winsymlinks", false, "enable winsymlinks")
+	fs.StringVar(&cfg.Priority, "priority", "", "process priority (idle, below, normal, above, high)")
+	fs.StringVar(&cfg.SaveConfig, "save-config", "", "write the effective configuration as JSON to `path`")
+	fs.BoolVar(&cfg.SaveConfigOnly, "save-config-only", false, "exit after -save-config instead of launching")
+	fs.BoolVar(&cfg.ExitHook, "login-shell-exit-hook", false, "diagnose profile errors when the shell exits non-zero right away")
+	fs.DurationVar(&cfg.ExitHookThreshold, "exit-hook-threshold", defaultExitHookThreshold, "exit time below which -login-shell-exit-hook triggers")
+	fs.BoolVar(&cfg.NoMotd, "no-motd", false, "set MSYS2_SHELL_NO_MOTD=1 for profile snippets that print a banner")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 0, "close an idle interactive shell after this long (sets TMOUT)")
+	fs.BoolVar(&cfg.Restricted, "restricted", false, "start a restricted shell (rbash, or bash -r)")
+	fs.StringVar(&cfg.Title, "title", "", "console window title (default MSYSTEM in a console of its own)")
+	fs.BoolVar(&cfg.SSHAgent, "ssh-agent", false, "export SSH_AUTH_SOCK for the shell")
+	fs.StringVar(&cfg.SSHAuthSock, "ssh-auth-sock", "", "agent socket `path` for -ssh-agent (default inherited SSH_AUTH_SOCK)")
+	fs.BoolVar(&cfg.Clear, "clear", false, "clear the terminal before starting the shell")
+	fs.Var(optionalString{&cfg.Tmux, defaultTmuxSession}, "tmux", "attach to or create tmux session (-tmux or -tmux=`session`)")
+	fs.BoolVar(&cfg.NoStdin, "no-stdin", false, "connect the shell's stdin to the null device")
+	fs.BoolVar(&cfg.NoStdout, "no-stdout", false, "connect the shell's stdout to the null device")
+	fs.BoolVar(&cfg.NoStderr, "no-stderr", false, "connect the shell's stderr to the null device")
+	fs.BoolVar(&cfg.InheritMsys, "inherit-msys", false, "carry the winsymlinks setting over from the inherited MSYS variable")
+	fs.BoolVar(&cfg.Shortcut, "shortcut", false, "print a shortcut target and start-in directory for this configuration and exit")
+	fs.IntVar(&cfg.LauncherExitCode, "launcher-exit-code", 0, "exit `code` for launcher errors (default 1)")
+	fs.BoolVar(&cfg.RestartOnExit, "restart-on-exit", false, "start the shell again whenever it exits")
+	fs.IntVar(&cfg.MaxRestarts, "max-restarts", 0, "stop after this many restarts (0 = unlimited)")
+	fs.DurationVar(&cfg.RestartBackoff, "restart-backoff", time.Second, "delay before each restart")
+	fs.IntVar(&cfg.RestartStopCode, "restart-stop-code", -1, "shell exit `code` that stops restarting (-1 = none)")
+	fs.BoolVar(&cfg.Job, "job", false, "run the shell in a job object that ends with the launcher")
+	fs.BoolVar(&cfg.PickShell, "pick-shell", false, "choose among installed shells when no shell is configured")
+	fs.StringVar(&cfg.LogFile, "log-file", "", "append launcher warnings to `path` instead of stderr")
+	fs.StringVar(&cfg.MirrorMsys, "mirror-msys", "", "export MSYS2_MIRROR_MSYS with this package mirror `url`")
+	fs.StringVar(&cfg.MirrorMingw, "mirror-mingw", "", "export MSYS2_MIRROR_MINGW with this package mirror `url`")
+	fs.BoolVar(&cfg.PrintCmdline, "print-cmdline", false, "print the shell invocation quoted for POSIX shells and exit")
+	fs.BoolVar(&cfg.DropAdmin, "drop-admin", false, "start the shell without administrator rights")
+	fs.BoolVar(&cfg.ListInstalled, "list-installed", false, "list the MSYSTEM environments installed under msysRoot and exit")
+	fs.BoolVar(&cfg.ListShells, "list-shells", false, "list the login shells installed in usr/bin and the MSYSTEM prefix and exit")
+	fs.StringVar(&cfg.Lang, "lang", "", "set LANG for the shell")
+	fs.StringVar(&cfg.LcAll, "lc-all", "", "set LC_ALL for the shell")
+	fs.BoolVar(&cfg.UTF8Locale, "utf8-locale", false, "set LANG and LC_ALL to C.UTF-8 unless given explicitly")
+	fs.StringVar(&cfg.DefaultDir, "default-dir", "", "start directory without -wd or -home (cwd, home)")
+	fs.BoolVar(&cfg.DumpDefaultConfig, "dump-default-config", false, "print the built-in default configuration and exit")
+	fs.StringVar(&cfg.ExpectVersion, "expect-version", "", "exit non-zero unless the launcher version is `version`, without launching")
+	fs.Var((*stringList)(&cfg.Unset), "unset", "remove variable `key` from the shell environment (repeatable)")
+	fs.BoolVar(&cfg.Guard, "guard", false, "ask for confirmation before launching with a risky configuration")
+	fs.BoolVar(&cfg.Script, "script", false, "run stdin as a non-interactive script; arguments after -- become $1...")
+	fs.BoolVar(&cfg.ErrExit, "errexit", false, "with -script, stop at the first failing command (set -e)")
+	fs.StringVar(&cfg.LoginMode, "login-mode", "", "shell startup mode: login (-l), interactive (-i), none; flags depend on the shell")
+	fs.StringVar(&cfg.WriteEnv, "write-env", "", "write the variables set by the launcher as KEY=VALUE lines to `path`")
+	fs.BoolVar(&cfg.WriteEnvOnly, "write-env-only", false, "exit after -write-env instead of launching")
+	fs.StringVar(&cfg.DotfilesDir, "dotfiles-dir", "", "use `dir` as HOME so the shell reads its dotfiles from there")
+	fs.BoolVar(&cfg.WarnMultiple, "warn-multiple", false, "warn about other MSYS2 installations in common locations")
+	fs.BoolVar(&cfg.NoSignalHandling, "no-signal-handling", false, "let signals such as Ctrl+C terminate the launcher normally")
+	fs.BoolVar(&cfg.OpenRoot, "open-root", false, "open msysRoot in Explorer and exit")
+	fs.BoolVar(&cfg.OpenHome, "open-home", false, "open the MSYS2 home directory in Explorer and exit")
+	fs.BoolVar(&cfg.WarnPathShadowing, "warn-path-shadowing", false, "with pathtype inherit, warn about tools present both in PATH and usr/bin")
+	fs.StringVar(&cfg.EnvModule, "env-module", "", "source the setup script configured for `name` in envModules before the shell")
+	fs.IntVar(&cfg.MaxPathWarn, "max-path-warn", defaultMaxPathWarn, "warn when the working directory is longer than this many characters (0 = off)")
+	fs.StringVar(&cfg.HistoryFile, "history-file", "", "use `path` as the shell history file (HISTFILE)")
+	fs.StringVar(&cfg.HistoryTemplate, "history-template", "", "seed the history file from `path` if it does not exist yet")
+	fs.StringVar(&cfg.AssertOutput, "assert-output", "", "run the command after -- and exit 0 only if its trimmed stdout is `text`")
+	fs.StringVar(&cfg.AssertRegex, "assert-regex", "", "like -assert-output, but match stdout against the regular expression `re`")
+	fs.StringVar(&cfg.Record, "record", "", "write the resolved launch, including the environment, as JSON to `path`")
+	fs.StringVar(&cfg.Replay, "replay", "", "launch exactly as recorded in `path` by -record, skipping configuration")
+	fs.BoolVar(&cfg.Probe, "probe", false, "check that the MSYSTEM is usable, print the result as JSON and exit")
+	fs.StringVar(&cfg.Wrapper, "wrapper", "", "run the shell under `program`, looked up in usr/bin if relative")
+	fs.Var((*stringList)(&cfg.WrapperArgs), "wrapper-arg", "pass `arg` to the -wrapper program before the shell (repeatable)")
+	fs.BoolVar(&cfg.EnableLongPaths, "enable-long-paths", false, "turn on Windows long path support (needs administrator rights) and exit")
+	fs.Var((*stringList)(&cfg.ExtraEnv), "env", "set `KEY=VALUE` in the shell environment; VALUE may use {{MSYSTEM}}, {{MSYSROOT}}, {{PREFIX}} (repeatable)")
+	fs.BoolVar(&cfg.EnableVT, "enable-vt", false, "turn on VT escape sequence processing in the console while the shell runs")
+	fs.BoolVar(&cfg.ViaWT, "via-wt", false, "open the shell in a new Windows Terminal tab instead of this console")
+	fs.BoolVar(&cfg.ValidateConfig, "validate-config", false, "check the configuration, report every problem and exit without launching")
+	fs.StringVar(&cfg.Prompt, "prompt", "", "use `PS1` as the bash prompt, set through PROMPT_COMMAND")
+	fs.BoolVar(&cfg.Capabilities, "capabilities", false, "print the features of this build as JSON and exit")
+	fs.BoolVar(&cfg.AsFlags, "as-flags", false, "print the flags equivalent to the merged configuration and exit")
+	fs.IntVar(&cfg.BufferLines, "buffer-lines", 0, "set the console screen buffer height to `n` lines for more scrollback")
+	fs.Var((*stringList)(&cfg.Creds), "cred", "set variable NAME to the secret of the Credential Manager entry TARGET, given as `NAME=TARGET` (repeatable)")
+	fs.BoolVar(&cfg.HupOnExit, "hup-on-exit", false, "when the launcher is asked to terminate, send SIGHUP to the shell and wait for it")
+	fs.Var((*stringList)(&cfg.Mounts), "mount", "mount Windows directory WIN at MSYS path POSIX in the mount table shared by all running MSYS2 programs, given as `WIN=POSIX` (repeatable)")
+	fs.StringVar(&cfg.CygdrivePrefix, "cygdrive-prefix", "", "mount Windows drives under `prefix` instead of / in the mount table shared by all running MSYS2 programs")
+	fs.BoolVar(&cfg.Setup, "setup", false, "interactively create msys2_shell.json next to the launcher and exit")
+	fs.BoolVar(&cfg.ProgressJSON, "progress-json", false, "report the start and exit of each shell run as JSON Lines on stderr")
+	fs.BoolVar(&cfg.PruneEnv, "prune-env", false, "drop large inherited variables when the environment nears the Windows size limit")
+	fs.BoolVar(&cfg.HomeWindows, "home-windows", false, "with -home, use the Windows user profile as HOME and start directory")
+	fs.BoolVar(&cfg.NoPathConv, "no-path-conversion", false, "turn off MSYS path conversion of arguments and environment variables")
+	fs.BoolVar(&cfg.PSWrapper, "powershell-wrapper", false, "print a PowerShell function that runs the launcher with this configuration and exit")
+	fs.StringVar(&cfg.ShellSHA256, "verify-shell-sha256", "", "refuse to launch unless the shell executable has this SHA-256 `hash`")
+	fs.BoolVar(&cfg.KeepMsysEnv, "keep-msystem-env", false, "when started from an MSYS2 shell, keep its MSYSTEM, MSYS2_PATH_TYPE and MSYS unless given by flags")
+	fs.StringVar(&cfg.PreCommand, "pre-command", "", "run `command` through cmd.exe (sh elsewhere) before the shell and abort if it fails")
+	fs.BoolVar(&cfg.PreCommandIgnoreErrors, "pre-command-ignore-errors", false, "launch the shell even if -pre-command fails")
+	fs.Var((*codeList)(&cfg.SuccessCodes), "success-codes", "exit 0 when the shell exits with one of these comma-separated `codes`")
+	fs.StringVar(&cfg.CaptureEnv, "capture-env", "", "run the command after -- in the shell and write the variables it changed to `path` as a .cmd or .ps1 script")
+	fs.StringVar(&cfg.OutputEncoding, "output-encoding", "", "convert the shell's UTF-8 stdout and stderr for Windows consumers (utf8, utf16, raw)")
+	fs.StringVar(&cfg.SysconfDir, "sysconfdir", "", "mount `dir` at /etc, in the mount table shared by all running MSYS2 programs, so the shell reads its profile from there")
+	fs.StringVar(&cfg.Analytics, "analytics", "", "append a JSON line with the time, MSYSTEM, path type and exit code of each launch to `path`")
+	fs.StringVar(&cfg.WaitForPath, "wait-for-path", "", "wait until `path` exists before launching, e.g. a network drive mounted at logon")
+	fs.DurationVar(&cfg.WaitTimeout, "wait-timeout", defaultWaitTimeout, "give up -wait-for-path after this long")
+	fs.BoolVar(&cfg.ExportCmdline, "export-cmdline", false, "export the launcher's unsplit Windows command line as MSYS2_SHELL_RAW_CMDLINE")
+	fs.StringVar(&cfg.AuditLog, "audit-log", "", "append every command run at the interactive bash prompt, with a timestamp, to `path`")
+	fs.BoolVar(&cfg.ShellFromPasswd, "shell-from-passwd", false, "use the login shell from /etc/passwd when no shell is configured")
+
+	for name, p := range platformFlags {
+		f := fs.Lookup(name)
+		if p.Available {
+			f.Usage += " (" + p.Platforms + " only)"
+		} else {
+			f.Usage += " (" + p.Platforms + " only, not available in this build)"
+		}
+	}
+	return fs
+}
+
+// parseLauncherFlags parses args for the program name and returns the
+// shell arguments after "--", which are nil without "--". Parse errors and
+// usage are printed by the flag set; a flag.ErrHelp error means -h was
+// requested.
+func parseLauncherFlags(name string, args []string) (Config, []string, error) {
+	var cfg Config
+	launcherArgs, shellArgs := splitOSArgs(args)
+	fs := newLauncherFlags(name, &cfg)
+	if err := fs.Parse(launcherArgs); err != nil {
+		return cfg, nil, err
+	}
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return cfg, nil, fmt.Errorf("%w: %s", errUnexpectedArgs, strings.Join(fs.Args(), " "))
+	}
+
+	return cfg, shellArgs, nil
+}
+
+// resolveConfig merges sources in order of increasing precedence: every
+// field set in a later source overrides the earlier ones. It depends only on
+// its arguments.
+func resolveConfig(sources []Config) Config {
+	var cfg Config
+	for _, src := range sources {
+		cfg = mergeConfig(cfg, src)
+	}
+	// A marker still present had no earlier list to extend.
+	cfg.DefaultShellArgs = withoutAppendMarker(cfg.DefaultShellArgs)
+	cfg.MsysRoots = withoutAppendMarker(cfg.MsysRoots)
+	return cfg
+}
+
+// appendMarker, as the first element of a list in a config source, makes
+// the other elements extend the list from earlier sources instead of
+// replacing it.
+const appendMarker = "+"
+
+// mergeList returns the list over merged onto base. over replaces base
+// unless it starts with appendMarker. While base is empty the marker is
+// kept, so that a config file still extends the sources it is layered on
+// later.
+func mergeList(base, over []string) []string {
+	if len(over) == 0 || over[0] != appendMarker || len(base) == 0 {
+		return over
+	}
+	return append(slices.Clip(base), over[1:]...)
+}
+
+// withoutAppendMarker returns l without a leading appendMarker.
+func withoutAppendMarker(l []string) []string {
+	if len(l) > 0 && l[0] == appendMarker {
+		return l[1:]
+	}
+	return l
+}
+
+func mergeConfig(base, cli Config) Config {
+	if cli.ConfigPaths != nil {
+		base.ConfigPaths = cli.ConfigPaths
+	}
+	if cli.ConfigFormat != "" {
+		base.ConfigFormat = cli.ConfigFormat
+	}
+	if cli.IgnoreConfig {
+		base.IgnoreConfig = true
+	}
+	if cli.LoginShell != "" {
+		base.LoginShell = cli.LoginShell
+	}
+	if cli.PathType != "" {
+		base.PathType = cli.PathType
+	}
+	if cli.MsysRoot != "" {
+		base.MsysRoot, base.MsysRoots = cli.MsysRoot, nil
+	}
+	if cli.MsysRoots != nil {
+		inherited := base.MsysRoots
+		if base.MsysRoot != "" {
+			inherited = []string{base.MsysRoot}
+		}
+		base.MsysRoot, base.MsysRoots = "", mergeList(inherited, cli.MsysRoots)
+	}
+	if cli.WinSymlinks {
+		base.WinSymlinks = true
+	}
+	if cli.Wd != "" {
+		base.Wd = cli.Wd
+	}
+	if cli.MSystem != "" {
+		base.MSystem = cli.MSystem
+	}
+	if cli.UseHome {
+		base.UseHome = true
+	}
+	if cli.ShellFromPasswd {
+		base.ShellFromPasswd = true
+	}
+	if cli.Priority != "" {
+		base.Priority = cli.Priority
+	}
+	if cli.SaveConfig != "" {
+		base.SaveConfig = cli.SaveConfig
+	}
+	if cli.SaveConfigOnly {
+		base.SaveConfigOnly = true
+	}
+	if cli.ExitHook {
+		base.ExitHook = true
+	}
+	if cli.ExitHookThreshold != 0 {
+		base.ExitHookThreshold = cli.ExitHookThreshold
+	}
+	if cli.NoMotd {
+		base.NoMotd = true
+	}
+	if cli.IdleTimeout != 0 {
+		base.IdleTimeout = cli.IdleTimeout
+	}
+	if cli.Restricted {
+		base.Restricted = true
+	}
+	if cli.Title != "" {
+		base.Title = cli.Title
+	}
+	if cli.ExecNameMap != nil {
+		base.ExecNameMap = cli.ExecNameMap
+	}
+	if cli.DefaultShellArgs != nil {
+		base.DefaultShellArgs = mergeList(base.DefaultShellArgs, cli.DefaultShellArgs)
+	}
+	if cli.SSHAgent {
+		base.SSHAgent = true
+	}
+	if cli.SSHAuthSock != "" {
+		base.SSHAuthSock = cli.SSHAuthSock
+	}
+	if cli.Clear {
+		base.Clear = true
+	}
+	if cli.Tmux != "" {
+		base.Tmux = cli.Tmux
+	}
+	if cli.NoStdin {
+		base.NoStdin = true
+	}
+	if cli.NoStdout {
+		base.NoStdout = true
+	}
+	if cli.NoStderr {
+		base.NoStderr = true
+	}
+	if cli.InheritMsys {
+		base.InheritMsys = true
+	}
+	if cli.Shortcut {
+		base.Shortcut = true
+	}
+	if cli.LauncherExitCode != 0 {
+		base.LauncherExitCode = cli.LauncherExitCode
+	}
+	if cli.RestartOnExit {
+		base.RestartOnExit = true
+	}
+	if cli.MaxRestarts != 0 {
+		base.MaxRestarts = cli.MaxRestarts
+	}
+	if cli.RestartBackoff != 0 {
+		base.RestartBackoff = cli.RestartBackoff
+	}
+	if cli.RestartStopCode != 0 {
+		base.RestartStopCode = cli.RestartStopCode
+	}
+	if cli.Job {
+		base.Job = true
+	}
+	if cli.PickShell {
+		base.PickShell = true
+	}
+	if cli.LogFile != "" {
+		base.LogFile = cli.LogFile
+	}
+	if cli.PrintCmdline {
+		base.PrintCmdline = true
+	}
+	if cli.DropAdmin {
+		base.DropAdmin = true
+	}
+	if cli.ListInstalled {
+		base.ListInstalled = true
+	}
+	if cli.ListShells {
+		base.ListShells = true
+	}
+	if cli.PreCommand != "" {
+		base.PreCommand = cli.PreCommand
+	}
+	if cli.PreCommandIgnoreErrors {
+		base.PreCommandIgnoreErrors = true
+	}
+	if len(cli.SuccessCodes) > 0 {
+		base.SuccessCodes = cli.SuccessCodes
+	}
+	if cli.CaptureEnv != "" {
+		base.CaptureEnv = cli.CaptureEnv
+	}
+	if cli.OutputEncoding != "" {
+		base.OutputEncoding = cli.OutputEncoding
+	}
+	if cli.SysconfDir != "" {
+		base.SysconfDir = cli.SysconfDir
+	}
+	if cli.Analytics != "" {
+		base.Analytics = cli.Analytics
+	}
+	if cli.WaitForPath != "" {
+		base.WaitForPath = cli.WaitForPath
+	}
+	if cli.WaitTimeout != 0 {
+		base.WaitTimeout = cli.WaitTimeout
+	}
+	if cli.ExportCmdline {
+		base.ExportCmdline = true
+	}
+	if cli.AuditLog != "" {
+		base.AuditLog = cli.AuditLog
+	}
+	if cli.DumpDefaultConfig {
+		base.DumpDefaultConfig = true
+	}
+	if cli.ExpectVersion != "" {
+		base.ExpectVersion = cli.ExpectVersion
+	}
+	if cli.Unset != nil {
+		base.Unset = cli.Unset
+	}
+	if cli.Guard {
+		base.Guard = true
+	}
+	if cli.Script {
+		base.Script = true
+	}
+	if cli.ErrExit {
+		base.ErrExit = true
+	}
+	if cli.LoginMode != "" {
+		base.LoginMode = cli.LoginMode
+	}
+	if cli.WriteEnv != "" {
+		base.WriteEnv = cli.WriteEnv
+	}
+	if cli.WriteEnvOnly {
+		base.WriteEnvOnly = true
+	}
+	if cli.DotfilesDir != "" {
+		base.DotfilesDir = cli.DotfilesDir
+	}
+	if cli.WarnMultiple {
+		base.WarnMultiple = true
+	}
+	if cli.NoSignalHandling {
+		base.NoSignalHandling = true
+	}
+	if cli.OpenRoot {
+		base.OpenRoot = true
+	}
+	if cli.OpenHome {
+		base.OpenHome = true
+	}
+	if cli.WarnPathShadowing {
+		base.WarnPathShadowing = true
+	}
+	if cli.EnvModule != "" {
+		base.EnvModule = cli.EnvModule
+	}
+	if cli.EnvModules != nil {
+		base.EnvModules = cli.EnvModules
+	}
+	if cli.Aliases != nil {
+		base.Aliases = cli.Aliases
+	}
+	if cli.MaxPathWarn != 0 {
+		base.MaxPathWarn = cli.MaxPathWarn
+	}
+	if cli.HistoryFile != "" {
+		base.HistoryFile = cli.HistoryFile
+	}
+	if cli.HistoryTemplate != "" {
+		base.HistoryTemplate = cli.HistoryTemplate
+	}
+	if cli.AssertOutput != "" {
+		base.AssertOutput = cli.AssertOutput
+	}
+	if cli.AssertRegex != "" {
+		base.AssertRegex = cli.AssertRegex
+	}
+	if cli.Record != "" {
+		base.Record = cli.Record
+	}
+	if cli.Replay != "" {
+		base.Replay = cli.Replay
+	}
+	if cli.Probe {
+		base.Probe = true
+	}
+	if cli.Wrapper != "" {
+		base.Wrapper = cli.Wrapper
+	}
+	if cli.WrapperArgs != nil {
+		base.WrapperArgs = cli.WrapperArgs
+	}
+	if cli.EnableLongPaths {
+		base.EnableLongPaths = true
+	}
+	if cli.EnableVT {
+		base.EnableVT = true
+	}
+	if cli.ViaWT {
+		base.ViaWT = true
+	}
+	if cli.ValidateConfig {
+		base.ValidateConfig = true
+	}
+	if cli.Prompt != "" {
+		base.Prompt = cli.Prompt
+	}
+	if cli.Capabilities {
+		base.Capabilities = true
+	}
+	if cli.AsFlags {
+		base.AsFlags = true
+	}
+	if cli.BufferLines != 0 {
+		base.BufferLines = cli.BufferLines
+	}
+	if cli.Creds != nil {
+		base.Creds = cli.Creds
+	}
+	if cli.HupOnExit {
+		base.HupOnExit = true
+	}
+	if cli.Mounts != nil {
+		base.Mounts = cli.Mounts
+	}
+	if cli.CygdrivePrefix != "" {
+		base.CygdrivePrefix = cli.CygdrivePrefix
+	}
+	if cli.Setup {
+		base.Setup = true
+	}
+	if cli.ProgressJSON {
+		base.ProgressJSON = true
+	}
+	if cli.PruneEnv {
+		base.PruneEnv = true
+	}
+	if cli.HomeWindows {
+		base.HomeWindows = true
+	}
+	if cli.NoPathConv {
+		base.NoPathConv = true
+	}
+	if cli.PSWrapper {
+		base.PSWrapper = true
+	}
+	if cli.ShellSHA256 != "" {
+		base.ShellSHA256 = cli.ShellSHA256
+	}
+	if cli.KeepMsysEnv {
+		base.KeepMsysEnv = true
+	}
+	// Later entries win in the environment, so sources always add to each
+	// other and an append marker changes nothing.
+	base.ExtraEnv = append(slices.Clip(base.ExtraEnv), withoutAppendMarker(cli.ExtraEnv)...)
+	if cli.Lang != "" {
+		base.Lang = cli.Lang
+	}
+	if cli.LcAll != "" {
+		base.LcAll = cli.LcAll
+	}
+	if cli.UTF8Locale {
+		base.UTF8Locale = true
+	}
+	if cli.DefaultDir != "" {
+		base.DefaultDir = cli.DefaultDir
+	}
+	if cli.MirrorMsys != "" {
+		base.MirrorMsys = cli.MirrorMsys
+	}
+	if cli.MirrorMingw != "" {
+		base.MirrorMingw = cli.MirrorMingw
+	}
+	return base
+}
+
+// installedMSystems returns the MSYSTEM names whose prefix has a bin
+// directory under root.
+func installedMSystems(root string) ([]string, error) {
+	if _, err := statWithTimeout(root); err != nil {
+		return nil, fmt.Errorf("read msysRoot failed: %w", err)
+	}
+	var installed []string
+	for _, p := range msystemPrefixes {
+		if fi, err := statWithTimeout(filepath.Join(root, p.Prefix, "bin")); err == nil && fi.IsDir() {
+			installed = append(installed, p.MSystem)
+		}
+	}
+	return installed, nil
+}
+
+// checkArch reports an error when the prefix of msystem is missing under
+// root while only environments of other architectures are installed there,
+// such as MINGW64 on an installation that only has MINGW32.
+func checkArch(root, msystem string) error {
+	var want string
+	for _, p := range msystemPrefixes {
+		if p.MSystem != msystem || p.Arch == "" {
+			continue
+		}
+		if fi, err := statWithTimeout(filepath.Join(root, p.Prefix, "bin")); err == nil && fi.IsDir() {
+			return nil
+		}
+		want = p.Arch
+	}
+	if want == "" {
+		return nil
+	}
+
+	installed, err := installedMSystems(root)
+	if err != nil {
+		return nil
+	}
+	var others []string
+	for _, m := range installed {
+		for _, p := range msystemPrefixes {
+			if p.MSystem != m || p.Arch == "" {
+				continue
+			}
+			if p.Arch == want {
+				return nil
+			}
+			others = append(others, fmt.Sprintf("%s (%s)", m, p.Arch))
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("architecture mismatch: %s (%s) is not installed under %s, which only has %s", msystem, want, root, strings.Join(others, ", "))
+	if runtime.GOARCH != want {
+		msg += "; this launcher is built for " + runtime.GOARCH
+	}
+	return errors.New(msg)
+}
+
+// waitForPath polls until path exists, giving up after timeout.
+func waitForPath(path string, timeout time.Duration) error {
+	const interval = 500 * time.Millisecond
+	if timeout < 0 {
+		return fmt.Errorf("invalid wait timeout '%s'", timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := statWithTimeout(path); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not appear within %s", path, timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// statWithTimeout is os.Stat, but gives up after statTimeout with an error
+// wrapping ErrStatTimeout.
+func statWithTimeout(name string) (os.FileInfo, error) {
+	type result struct {
+		fi  os.FileInfo
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		fi, err := os.Stat(name)
+		ch <- result{fi, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.fi, r.err
+	case <-time.After(statTimeout):
+		return nil, fmt.Errorf("stat %s %w after %s: msysRoot may be on an unreachable network location", name, ErrStatTimeout, statTimeout)
+	}
+}
+
+// runSetup asks for msysRoot, the default MSYSTEM and the login shell, and
+// writes them to the config file path. Only installed environments are
+// offered.
+func runSetup(path string) {
+	if !isTerminal(os.Stdin) {
+		fatal(errors.New("-setup needs an interactive terminal"))
+	}
+	in := bufio.NewScanner(os.Stdin)
+	ask := func(format string, a ...any) string {
+		_, _ = fmt.Fprintf(os.Stderr, format, a...)
+		if !in.Scan() {
+			fatal(errors.New("setup aborted"))
+		}
+		return strings.TrimSpace(in.Text())
+	}
+	hasBash := func(root string) bool {
+		_, err := statWithTimeout(filepath.Join(root, "usr", "bin", exeName("bash")))
+		return err == nil
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if a := strings.ToLower(ask("%s exists; overwrite? [y/N] ", path)); a != "y" && a != "yes" {
+			fatal(errors.New("setup aborted"))
+		}
+	}
+
+	var roots []string
+	for _, r := range commonMsysRoots() {
+		if hasBash(r) {
+			roots = append(roots, r)
+		}
+	}
+	for i, r := range roots {
+		_, _ = fmt.Fprintf(os.Stderr, "%d) %s\n", i+1, r)
+	}
+	var root string
+	for root == "" {
+		var answer string
+		if len(roots) > 0 {
+			answer = ask("MSYS2 root, number or path [1]: ")
+			if answer == "" {
+				answer = "1"
+			}
+		} else {
+			answer = ask("MSYS2 root path: ")
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(roots) {
+			root = roots[n-1]
+		} else if answer != "" && hasBash(normalizePath(answer)) {
+			root = normalizePath(answer)
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "no MSYS2 installation at %s\n", answer)
+		}
+	}
+
+	installed, err := installedMSystems(root)
+	if err != nil {
+		fatal(err)
+	}
+	def := installed[0]
+	if slices.Contains(installed, "UCRT64") {
+		def = "UCRT64"
+	}
+	for i, m := range installed {
+		_, _ = fmt.Fprintf(os.Stderr, "%d) %s\n", i+1, m)
+	}
+	var msystem string
+	for msystem == "" {
+		answer := ask("default MSYSTEM [%s]: ", def)
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(installed) {
+			msystem = installed[n-1]
+		} else if answer == "" {
+			msystem = def
+		} else if m := getMSystemFromName(answer); slices.Contains(installed, m) {
+			msystem = m
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "%s is not installed under %s\n", answer, root)
+		}
+	}
+
+	shell := cmp.Or(pickShell(root), defaultLoginShell)
+	saveJSONConfig(path, Config{MsysRoot: root, MSystem: msystem, LoginShell: shell})
+	_, _ = fmt.Fprintf(os.Stderr, "wrote %s\n", path)
+}
+
+// pickMsysRoot returns the first of candidates that contains usr/bin/bash.
+func pickMsysRoot(candidates []string) (string, error) {
+	var tried []string
+	for _, c := range candidates {
+		c = normalizePath(c)
+		if _, err := statWithTimeout(filepath.Join(c, "usr", "bin", exeName("bash"))); err == nil {
+			return c, nil
+		}
+		tried = append(tried, c)
+	}
+	return "", fmt.Errorf("no MSYS2 installation found in msysRoot candidates: %s", strings.Join(tried, ", "))
+}
+
+// commonMsysRoots returns the usual install locations of MSYS2 and of
+// MSYS2-based distributions such as Git for Windows.
+func commonMsysRoots() []string {
+	roots := []string{`C:\msys64`, `C:\msys32`, `C:\tools\msys64`}
+	if v := os.Getenv("ProgramFiles"); v != "" {
+		roots = append(roots, filepath.Join(v, "Git"))
+	}
+	if v := os.Getenv("LOCALAPPDATA"); v != "" {
+		roots = append(roots, filepath.Join(v, "Programs", "Git"))
+	}
+	if v := os.Getenv("USERPROFILE"); v != "" {
+		roots = append(roots,
+			filepath.Join(v, "scoop", "apps", "msys2", "current"),
+			filepath.Join(v, "scoop", "apps", "git", "current"))
+	}
+	return roots
+}
+
+// otherMsysRoots returns the MSYS2-looking installations in common
+// locations other than root.
+func otherMsysRoots(root string) []string {
+	var others []string
+	for _, r := range commonMsysRoots() {
+		if strings.EqualFold(filepath.Clean(r), filepath.Clean(root)) {
+			continue
+		}
+		if _, err := statWithTimeout(filepath.Join(r, "usr", "bin", exeName("bash"))); err == nil {
+			others = append(others, r)
+		}
+	}
+	return others
+}
+
+// shadowedTools are commonly found both in MSYS2 and on the Windows PATH.
+var shadowedTools = []string{"find", "sort", "link", "tar", "curl", "ssh", "git", "python"}
+
+// pathShadowing returns a description of each tool in shadowedTools that
+// exists both under root/usr/bin and in a directory of the inherited PATH.
+// The MSYS2 login profile puts usr/bin first, so the shell picks that one.
+func pathShadowing(root string) []string {
+	binDir := filepath.Join(root, "usr", "bin")
+	var dirs []string
+	for _, d := range filepath.SplitList(os.Getenv("PATH")) {
+		if d != "" && !strings.HasPrefix(strings.ToLower(filepath.Clean(d)), strings.ToLower(filepath.Clean(root))) {
+			dirs = append(dirs, d)
+		}
+	}
+
+	var found []string
+	for _, tool := range shadowedTools {
+		msysTool := filepath.Join(binDir, exeName(tool))
+		if _, err := os.Stat(msysTool); err != nil {
+			continue
+		}
+		for _, d := range dirs {
+			winTool := filepath.Join(d, exeName(tool))
+			if _, err := os.Stat(winTool); err == nil {
+				found = append(found, fmt.Sprintf("%s: shell uses %s, not %s", tool, msysTool, winTool))
+				break
+			}
+		}
+	}
+	return found
+}
+
+// normalizePath strips stray whitespace and surrounding quotes from a
+// configured path and cleans it.
+func normalizePath(p string) string {
+	p = strings.TrimSpace(p)
+	if len(p) >= 2 && (p[0] == '"' || p[0] == '\'') && p[len(p)-1] == p[0] {
+		p = p[1 : len(p)-1]
+	}
+	if p == "" {
+		return ""
+	}
+	return filepath.Clean(p)
+}
+
+// resolveMSystem returns the MSYSTEM implied by the launcher name or given
+// with -msystem, falling back to the configured default.
+func resolveMSystem(execName, cli, configured string, custom map[string]string) string {
+	auto := getMSystemFromExecName(execName, custom)
+	if auto != "" && cli != "" {
+		fatal(fmt.Errorf("conflict: exec name implies %s but -msystem flag provides %s", auto, cli))
+	}
+	if auto == "" && cli == "" {
+		if configured == "" {
+			fatal(errors.New("MSYSTEM not specified: rename exe, use -msystem flag or set msystem in the config"))
+		}
+		cli = configured
+	}
+	if cli != "" {
+		v := getMSystemFromName(cli)
+		if v == "" {
+			fatal(fmt.Errorf("%w: %s", ErrInvalidMSystem, cli))
+		}
+		return v
+	}
+	return auto
+}
+
+// configProblems checks the values of cfg and the paths it refers to,
+// returning every problem found instead of stopping at the first.
+func configProblems(cfg Config) []error {
+	var errs []error
+	if cfg.PathType != "" && !validPathTypes[strings.ToLower(cfg.PathType)] {
+		errs = append(errs, fmt.Errorf("%w '%s'", ErrInvalidPathType, cfg.PathType))
+	}
+	switch strings.ToLower(cfg.LoginMode) {
+	case "", "login", "interactive", "none":
+	default:
+		errs = append(errs, fmt.Errorf("invalid login mode '%s'", cfg.LoginMode))
+	}
+	switch strings.ToLower(cfg.DefaultDir) {
+	case "", "cwd", "home":
+	default:
+		errs = append(errs, fmt.Errorf("invalid default directory '%s'", cfg.DefaultDir))
+	}
+	switch strings.ToLower(cfg.OutputEncoding) {
+	case "", "utf8", "utf16", "raw":
+	default:
+		errs = append(errs, fmt.Errorf("invalid output encoding '%s'", cfg.OutputEncoding))
+	}
+	for name, msystem := range cfg.ExecNameMap {
+		if getMSystemFromName(msystem) == "" {
+			errs = append(errs, fmt.Errorf("%w in execNameMap for %s: %s", ErrInvalidMSystem, name, msystem))
+		}
+	}
+	if cfg.MSystem != "" && getMSystemFromName(cfg.MSystem) == "" {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidMSystem, cfg.MSystem))
+	}
+	for _, kv := range cfg.ExtraEnv {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			errs = append(errs, fmt.Errorf("invalid env entry '%s': expected KEY=VALUE", kv))
+		}
+	}
+	if cfg.ShellSHA256 != "" && !validSHA256(cfg.ShellSHA256) {
+		errs = append(errs, fmt.Errorf("invalid SHA-256 hash '%s'", cfg.ShellSHA256))
+	}
+	if cfg.WaitForPath != "" {
+		if err := waitForPath(cfg.WaitForPath, cfg.WaitTimeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(cfg.MsysRoots) > 0 {
+		root, err := pickMsysRoot(cfg.MsysRoots)
+		if err != nil {
+			return append(errs, err)
+		}
+		cfg.MsysRoot = root
+	}
+	cfg.MsysRoot = normalizePath(cfg.MsysRoot)
+	if cfg.MsysRoot == "" {
+		return append(errs, errors.New("missing configuration: msysRoot not specified"))
+	}
+	if _, err := statWithTimeout(cfg.MsysRoot); err != nil {
+		return append(errs, fmt.Errorf("msysRoot not found: %w", err))
+	}
+	if cfg.LoginShell != "" {
+		shellPath := filepath.Join(cfg.MsysRoot, "usr", "bin", exeName(cfg.LoginShell))
+		if _, err := statWithTimeout(shellPath); err != nil {
+			errs = append(errs, fmt.Errorf("%w at %s: %w", ErrShellNotFound, shellPath, err))
+		}
+	}
+	for name, script := range cfg.EnvModules {
+		if _, err := statWithTimeout(filepath.Join(cfg.MsysRoot, filepath.FromSlash(script))); err != nil {
+			errs = append(errs, fmt.Errorf("env module %s: script not found: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// shellFromPasswd looks up username in root/etc/passwd and returns the
+// shell field as a name under /usr/bin.
+func shellFromPasswd(root, username string) (string, error) {
+	passwdPath := filepath.Join(root, "etc", "passwd")
+	data, err := os.ReadFile(passwdPath)
+	if err != nil {
+		return "", fmt.Errorf("read passwd failed: %w", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), ":")
+		if len(fields) < 7 || !strings.EqualFold(fields[0], username) {
+			continue
+		}
+		dir, name := path.Split(fields[6])
+		if (dir != "/usr/bin/" && dir != "/bin/") || name == "" {
+			return "", fmt.Errorf("unsupported shell '%s' in %s", fields[6], passwdPath)
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("user %s not found in %s", username, passwdPath)
+}
+
+// commonShells are the shell names -list-shells looks for.
+var commonShells = []string{"bash", "dash", "fish", "mksh", "tcsh", "zsh"}
+
+// installedShells returns the MSYS paths of the common shells found in
+// root/usr/bin and, if msystem has its own prefix, in its bin directory.
+func installedShells(root, msystem string) []string {
+	dirs := []string{"usr"}
+	for _, p := range msystemPrefixes {
+		if p.MSystem == msystem && p.Prefix != "usr" {
+			dirs = append(dirs, p.Prefix)
+		}
+	}
+	var shells []string
+	for _, d := range dirs {
+		for _, name := range commonShells {
+			if fi, err := statWithTimeout(filepath.Join(root, d, "bin", exeName(name))); err == nil && !fi.IsDir() {
+				shells = append(shells, "/"+d+"/bin/"+name)
+			}
+		}
+	}
+	return shells
+}
+
+// pickShell lists the *sh.exe binaries under root/usr/bin and asks the
+// user to choose one. It returns "" when there is nothing to choose from or
+// the user accepts the default.
+func pickShell(root string) string {
+	matches, _ := filepath.Glob(filepath.Join(root, "usr", "bin", "*sh"+exeSuffix))
+	var shells []string
+	for _, m := range matches {
+		name := strings.TrimSuffix(filepath.Base(m), exeSuffix)
+		if name != "ssh" {
+			shells = append(shells, name)
+		}
+	}
+	if len(shells) < 2 {
+		return ""
+	}
+
+	for i, sh := range shells {
+		_, _ = fmt.Fprintf(os.Stderr, "%d) %s\n", i+1, sh)
+	}
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		_, _ = fmt.Fprintf(os.Stderr, "choose a shell [%s]: ", defaultLoginShell)
+		if !in.Scan() {
+			return ""
+		}
+		answer := strings.TrimSpace(in.Text())
+		if answer == "" {
+			return ""
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(shells) {
+			return shells[n-1]
+		}
+	}
+}
+
+func validatePathType(pt string) string {
+	lower := strings.ToLower(pt)
+	if !validPathTypes[lower] {
+		fatal(fmt.Errorf("%w '%s'", ErrInvalidPathType, pt))
+	}
+	return lower
+}
+
+func validateDefaultDir(d string) string {
+	switch lower := strings.ToLower(d); lower {
+	case "", "cwd", "home":
+		return lower
+	default:
+		fatal(fmt.Errorf("invalid default directory '%s'", d))
+		return ""
+	}
+}
+
+// shellFlags are the arguments a shell takes to start as a login shell, to
+// start as an interactive shell and to run a command string.
+type shellFlags struct {
+	Login       string
+	Interactive string
+	Command     string
+}
+
+// shellFlagTable maps shell names to their flags. Shells not listed are
+// assumed to take the same flags as bash.
+var shellFlagTable = map[string]shellFlags{
+	"bash": {"-l", "-i", "-c"},
+	"dash": {"-l", "-i", "-c"},
+	"fish": {"--login", "--interactive", "-c"},
+	"mksh": {"-l", "-i", "-c"},
+	"sh":   {"-l", "-i", "-c"},
+	"zsh":  {"-l", "-i", "-c"},
+}
+
+// flagsForShell returns the flags of shell, given as a name or path.
+func flagsForShell(shell string) shellFlags {
+	name := strings.ToLower(filepath.Base(shell))
+	for _, ext := range executableExts {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if f, ok := shellFlagTable[name]; ok {
+		return f
+	}
+	return shellFlagTable["bash"]
+}
+
+// loginModeArgs returns the shell arguments selecting login mode m.
+func loginModeArgs(m string, f shellFlags) []string {
+	switch m {
+	case "login":
+		return []string{f.Login}
+	case "interactive":
+		return []string{f.Interactive}
+	default:
+		return nil
+	}
+}
+
+func validateLoginMode(m string) string {
+	switch lower := strings.ToLower(m); lower {
+	case "":
+		return "login"
+	case "login", "interactive", "none":
+		return lower
+	default:
+		fatal(fmt.Errorf("invalid login mode '%s'", m))
+		return ""
+	}
+}
+
+func validateOutputEncoding(e string) string {
+	switch lower := strings.ToLower(e); lower {
+	case "":
+		return "raw"
+	case "utf8", "utf16", "raw":
+		return lower
+	default:
+		fatal(fmt.Errorf("invalid output encoding '%s'", e))
+		return ""
+	}
+}
+
+func validatePriority(p string) string {
+	lower := strings.ToLower(p)
+	if !validPriorities[lower] {
+		fatal(fmt.Errorf("invalid priority '%s'", p))
+	}
+	return lower
+}
+
+// idleTimeoutSeconds converts d to whole seconds for TMOUT, rounding up so
+// that sub-second values do not disable the timeout.
+func idleTimeoutSeconds(d time.Duration) int {
+	if d < 0 {
+		fatal(fmt.Errorf("invalid idle timeout '%s'", d))
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// shellQuote quotes s for POSIX shells, leaving it bare when it only holds
+// characters that need no quoting.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./:=@%+,") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printCmdline prints a POSIX shell command line that reproduces the
+// launch from inside MSYS2.
+func printCmdline(s Spec) {
+	// Inside MSYS2 the Windows command line limit does not apply, so the
+	// line is printed in full instead of through a temporary script.
+	cmd, err := buildShellCmd(s, false)
+	if err != nil {
+		fatal(err)
+	}
+
+	var parts []string
+	if cmd.Dir != "" {
+		parts = append(parts, "cd", shellQuote(msysPath(cmd.Dir)), "&&")
+	}
+	for _, kv := range launcherEnv(s.Cfg) {
+		k, v, _ := strings.Cut(kv, "=")
+		parts = append(parts, k+"="+shellQuote(v))
+	}
+	parts = append(parts, shellQuote(msysPath(cmd.Path)))
+	for _, a := range cmd.Args[1:] {
+		parts = append(parts, shellQuote(a))
+	}
+	fmt.Println(strings.Join(parts, " "))
+}
+
+// windowsQuoteArg quotes s so that CommandLineToArgvW parses it back as a
+// single argument.
+func windowsQuoteArg(s string) string {
+	if s == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			slashes++
+		case '"':
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// psQuote quotes s as a PowerShell single-quoted string. PowerShell also
+// accepts the typographic single quotes as delimiters, so they are doubled
+// like the ASCII one.
+func psQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// msysPath converts a Windows path such as C:\foo\bar to its MSYS form
+// /c/foo/bar. Other paths are returned with forward slashes.
+func msysPath(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if len(p) >= 2 && p[1] == ':' {
+		p = "/" + strings.ToLower(p[:1]) + p[2:]
+	}
+	return p
+}
+
+// windowsPath converts an absolute MSYS path to its Windows form, the
+// reverse of msysPath: /c/foo becomes C:\foo and other absolute paths are
+// taken to be under root. Relative paths are returned unchanged.
+func windowsPath(root, p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	if len(p) >= 2 && unicode.IsLetter(rune(p[1])) && (len(p) == 2 || p[2] == '/') {
+		return strings.ToUpper(p[1:2]) + `:\` + strings.ReplaceAll(strings.TrimPrefix(p[2:], "/"), "/", `\`)
+	}
+	return strings.TrimRight(root, `\/`) + strings.ReplaceAll(p, "/", `\`)
+}
+
+// msysToken returns the token for key from an MSYS value such as
+// "winsymlinks:nativestrict disable_pcon", or "" if it is absent.
+func msysToken(msys, key string) string {
+	for _, tok := range strings.Fields(msys) {
+		name, _, _ := strings.Cut(tok, ":")
+		if name == key {
+			return tok
+		}
+	}
+	return ""
+}
+
+func applyEnv(cfg Config) ([]string, error) {
+	own := launcherEnv(cfg)
+	// Secrets are only added here, so that -write-env and -print-cmdline do
+	// not show them.
+	for _, c := range cfg.Creds {
+		name, target, _ := strings.Cut(c, "=")
+		secret, err := readCredential(target)
+		if err != nil {
+			return nil, fmt.Errorf("read credential '%s' failed: %w", target, err)
+		}
+		own = append(own, name+"="+secret)
+	}
+	env := append(os.Environ(), own...)
+	if len(cfg.Unset) > 0 {
+		env = slices.DeleteFunc(env, func(kv string) bool {
+			k, _, _ := strings.Cut(kv, "=")
+			return slices.ContainsFunc(cfg.Unset, func(u string) bool { return envKeyEqual(k, u) })
+		})
+	}
+
+	if n := envBlockSize(env); n > envBlockWarn {
+		if !cfg.PruneEnv {
+			warn(fmt.Errorf("environment is %d characters, close to the Windows limit of %d; starting the shell may fail: remove variables with -unset or pass -prune-env", n, maxEnvBlock))
+			return env, nil
+		}
+		var dropped []string
+		env, dropped = pruneEnv(env, own)
+		warn(fmt.Errorf("environment was %d characters, close to the Windows limit of %d; dropped %s", n, maxEnvBlock, strings.Join(dropped, ", ")))
+	}
+	return env, nil
+}
+
+// maxEnvBlock is the size of the environment block, in UTF-16 code units,
+// that older Windows versions and many programs cannot go beyond.
+const maxEnvBlock = 32767
+
+// envBlockWarn is the environment size from which applyEnv warns or prunes.
+const envBlockWarn = maxEnvBlock * 9 / 10
+
+// essentialEnv are inherited variables that -prune-env never drops.
+var essentialEnv = []string{
+	"PATH", "PATHEXT", "COMSPEC", "SYSTEMROOT", "SYSTEMDRIVE", "WINDIR",
+	"TEMP", "TMP", "USERNAME", "USERPROFILE", "HOMEDRIVE", "HOMEPATH",
+	"APPDATA", "LOCALAPPDATA", "PROGRAMDATA", "PROGRAMFILES", "HOME",
+}
+
+// envBlockSize returns the size of the Windows environment block for env:
+// each KEY=VALUE string and the final terminator, NUL-terminated.
+func envBlockSize(env []string) int {
+	n := 1
+	for _, kv := range env {
+		n += len(utf16.Encode([]rune(kv))) + 1
+	}
+	return n
+}
+
+// pruneEnv drops inherited variables from env, largest first, until it is
+// below envBlockWarn. Variables set by the launcher (own) and essentialEnv
+// are kept. It returns the new environment and the dropped names.
+func pruneEnv(env, own []string) ([]string, []string) {
+	keep := func(k string) bool {
+		isKey := func(kv string) bool {
+			name, _, _ := strings.Cut(kv, "=")
+			return envKeyEqual(name, k)
+		}
+		return slices.ContainsFunc(own, isKey) || slices.ContainsFunc(essentialEnv, func(e string) bool { return envKeyEqual(e, k) })
+	}
+
+	var candidates []string
+	for _, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); !keep(k) {
+			candidates = append(candidates, kv)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return len(candidates[i]) > len(candidates[j]) })
+
+	size := envBlockSize(env)
+	var dropped []string
+	for _, kv := range candidates {
+		if size <= envBlockWarn {
+			break
+		}
+		size -= len(utf16.Encode([]rune(kv))) + 1
+		k, _, _ := strings.Cut(kv, "=")
+		dropped = append(dropped, k)
+		env = slices.DeleteFunc(env, func(e string) bool { return e == kv })
+	}
+	return env, dropped
+}
+
+// envKeyEqual compares environment variable names, ignoring case on
+// Windows.
+func envKeyEqual(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// launcherEnv returns the variables the launcher sets on top of the
+// inherited environment.
+func launcherEnv(cfg Config) []string {
+	pt := validatePathType(cfg.PathType)
+	var env []string
+
+	env = append(env, "MSYSTEM="+cfg.MSystem)
+	env = append(env, "CHERE_INVOKING=1")
+	env = append(env, "MSYS2_PATH_TYPE="+pt)
+
+	msysVal := ""
+	if cfg.WinSymlinks {
+		msysVal = "winsymlinks:nativestrict"
+	} else if cfg.KeepMsysEnv {
+		msysVal = os.Getenv("MSYS")
+	} else if cfg.InheritMsys {
+		msysVal = msysToken(os.Getenv("MSYS"), "winsymlinks")
+	}
+	env = append(env, "MSYS="+msysVal)
+
+	if cfg.NoMotd {
+		env = append(env, "MSYS2_SHELL_NO_MOTD=1")
+	}
+	if cfg.NoPathConv {
+		env = append(env, "MSYS2_ARG_CONV_EXCL=*", "MSYS2_ENV_CONV_EXCL=*")
+	}
+	if cfg.SysconfDir != "" {
+		env = append(env, "MSYS2_SHELL_SYSCONFDIR="+msysPath(cfg.SysconfDir))
+	}
+	if cfg.ExportCmdline {
+		env = append(env, "MSYS2_SHELL_RAW_CMDLINE="+rawCommandLine())
+	}
+	if cfg.IdleTimeout != 0 {
+		env = append(env, "TMOUT="+strconv.Itoa(idleTimeoutSeconds(cfg.IdleTimeout)))
+	}
+	if cfg.SSHAgent {
+		sock := cfg.SSHAuthSock
+		if sock == "" {
+			sock = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if sock == "" {
+			fatal(errors.New("missing configuration: -ssh-agent needs SSH_AUTH_SOCK or sshAuthSock"))
+		}
+		env = append(env, "SSH_AUTH_SOCK="+msysPath(sock))
+	}
+	if cfg.MirrorMsys != "" {
+		env = append(env, "MSYS2_MIRROR_MSYS="+cfg.MirrorMsys)
+	}
+	if cfg.MirrorMingw != "" {
+		env = append(env, "MSYS2_MIRROR_MINGW="+cfg.MirrorMingw)
+	}
+
+	if cfg.DotfilesDir != "" {
+		home := msysPath(cfg.DotfilesDir)
+		env = append(env, "HOME="+home, "XDG_CONFIG_HOME="+home+"/.config")
+	}
+	if cfg.HomeWindows {
+		env = append(env, "HOME="+msysPath(os.Getenv("USERPROFILE")))
+	}
+	if cfg.HistoryFile != "" {
+		env = append(env, "HISTFILE="+msysPath(cfg.HistoryFile))
+	}
+	var promptCommand []string
+	if cfg.Prompt != "" {
+		// The profile sets PS1 after the environment is read, so the prompt
+		// is applied before each prompt is shown instead.
+		env = append(env, "MSYS2_SHELL_PROMPT="+cfg.Prompt)
+		promptCommand = append(promptCommand, "PS1=$MSYS2_SHELL_PROMPT")
+	}
+	if cfg.AuditLog != "" {
+		env = append(env, "MSYS2_SHELL_AUDIT_LOG="+msysPath(cfg.AuditLog))
+		promptCommand = slices.Concat([]string{auditSkip, auditTrap}, promptCommand, []string{auditUnskip})
+	}
+	if len(promptCommand) > 0 {
+		env = append(env, "PROMPT_COMMAND="+strings.Join(promptCommand, "; "))
+	}
+
+	lang, lcAll := cfg.Lang, cfg.LcAll
+	if cfg.UTF8Locale {
+		lang = cmp.Or(lang, "C.UTF-8")
+		lcAll = cmp.Or(lcAll, "C.UTF-8")
+	}
+	if lang != "" {
+		env = append(env, "LANG="+lang)
+	}
+	if lcAll != "" {
+		env = append(env, "LC_ALL="+lcAll)
+	}
+	return append(env, expandEnvTemplates(cfg)...)
+}
+
+// auditSkip, auditTrap and auditUnskip make up the PROMPT_COMMAND of
+// -audit-log. On the first prompt, a DEBUG trap is installed that appends
+// each command bash is about to run to MSYS2_SHELL_AUDIT_LOG. The trap
+// ignores the commands between auditSkip and auditUnskip, which enclose the
+// rest of PROMPT_COMMAND.
+const (
+	auditSkip   = "__msys2_audit_skip=1"
+	auditUnskip = "__msys2_audit_skip="
+	auditTrap   = `[ -n "$__msys2_audit_trap" ] || { __msys2_audit_trap=1; trap '[ -n "$__msys2_audit_skip" ] || [ "$BASH_COMMAND" = ` + auditSkip + ` ] || printf "%(%Y-%m-%dT%H:%M:%S%z)T %s %s\n" -1 "${USERNAME:-$USER}" "$BASH_COMMAND" >>"$MSYS2_SHELL_AUDIT_LOG"' DEBUG; }`
+)
+
+// expandEnvTemplates checks the -env entries of cfg and replaces the
+// placeholders {{MSYSTEM}}, {{MSYSROOT}} and {{PREFIX}} in their values.
+func expandEnvTemplates(cfg Config) []string {
+	prefix := ""
+	for _, p := range msystemPrefixes {
+		if p.MSystem == cfg.MSystem {
+			prefix = "/" + p.Prefix
+		}
+	}
+	vars := map[string]string{
+		"MSYSTEM":  cfg.MSystem,
+		"MSYSROOT": cfg.MsysRoot,
+		"PREFIX":   prefix,
+	}
+
+	var out []string
+	for _, kv := range cfg.ExtraEnv {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			fatal(fmt.Errorf("invalid env entry '%s': expected KEY=VALUE", kv))
+		}
+		var b strings.Builder
+		for {
+			start := strings.Index(v, "{{")
+			if start < 0 {
+				break
+			}
+			end := strings.Index(v[start:], "}}")
+			if end < 0 {
+				break
+			}
+			name := v[start+2 : start+end]
+			val, ok := vars[name]
+			if !ok {
+				fatal(fmt.Errorf("invalid placeholder '{{%s}}' in env entry '%s'", name, kv))
+			}
+			b.WriteString(v[:start])
+			b.WriteString(val)
+			v = v[start+end+2:]
+		}
+		b.WriteString(v)
+		out = append(out, k+"="+b.String())
+	}
+	return out
+}
+
+// msysHome returns the MSYS2 home directory of the current user.
+func msysHome(root string) string {
+	username := os.Getenv("USERNAME")
+	if username == "" {
+		fatal(errors.New("USERNAME not set"))
+	}
+	return filepath.Join(root, "home", username)
+}
+
+// seedHistory copies the history template to the history file unless that
+// file already exists. Without -history-file the target is .bash_history in
+// the shell's HOME.
+func seedHistory(cfg Config) error {
+	target := cfg.HistoryFile
+	if target == "" {
+		home := cfg.DotfilesDir
+		if home == "" {
+			home = msysHome(cfg.MsysRoot)
+		}
+		target = filepath.Join(home, ".bash_history")
+	}
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.HistoryTemplate)
+	if err != nil {
+		return fmt.Errorf("read history template failed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("seed history failed: %w", err)
+	}
+	if err := os.WriteFile(target, data, 0o600); err != nil {
+		return fmt.Errorf("seed history failed: %w", err)
+	}
+	return nil
+}
+
+// launcherPaths returns the resolved launcher path, used to locate the
+// config file, and the invoked name, used to infer MSYSTEM. The invoked name
+// comes from argv0 because a symlinked launcher's name carries the intent.
+func launcherPaths(argv0 string) (string, string) {
+	execPath, err := os.Executable()
+	if err != nil {
+		fatal(fmt.Errorf("failed to get launcher path: %w", err))
+	}
+	if p, err := filepath.EvalSymlinks(execPath); err == nil {
+		execPath = p
+	}
+
+	execName := filepath.Base(execPath)
+	if argv0 != "" {
+		execName = filepath.Base(argv0)
+	}
+	return execPath, execName
+}
+
+func resolveSpec() Spec {
+	execPath, execName := launcherPaths(os.Args[0])
+
+	args := os.Args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		// -config is not parsed yet, so aliases come from the default file.
+		cfg := resolveConfig([]Config{
+			configs.Defaults(),
+			configs.Load(filepath.Join(filepath.Dir(execPath), "msys2_shell.json"), ""),
+		})
+		var err error
+		if args, err = expandAlias(args, cfg.Aliases); err != nil {
+			fatal(err)
+		}
+	}
+	args, err := expandResponseFile(args)
+	if err != nil {
+		fatal(err)
+	}
+	cli, rest, err := parseLauncherFlags(os.Args[0], args)
+	shellArgs := rest
+	if err != nil {
+		os.Exit(parseExitCode(err, cli.LauncherExitCode))
+	}
+	if cli.LauncherExitCode < 0 || cli.LauncherExitCode > 255 {
+		fatal(fmt.Errorf("invalid launcher exit code %d", cli.LauncherExitCode))
+	}
+	if cli.LauncherExitCode != 0 {
+		launcherExitCode = cli.LauncherExitCode
+	}
+	if cli.LogFile != "" {
+		f, err := os.OpenFile(cli.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fatal(fmt.Errorf("open log file failed: %w", err))
+		}
+		diagOut = f
+	}
+
+	if cli.DumpDefaultConfig {
+		_, _ = os.Stdout.Write(defaultConfigJSON)
+		os.Exit(0)
+	}
+	if cli.Setup {
+		runSetup(filepath.Join(filepath.Dir(execPath), "msys2_shell.json"))
+		os.Exit(0)
+	}
+	if cli.Capabilities {
+		if err := json.NewEncoder(os.Stdout).Encode(capabilities()); err != nil {
+			fatal(fmt.Errorf("encode capabilities failed: %w", err))
+		}
+		os.Exit(0)
+	}
+	if cli.EnableLongPaths {
+		if err := enableLongPaths(); err != nil {
+			fatal(fmt.Errorf("enable long paths failed: %w", err))
+		}
+		os.Exit(0)
+	}
+	if cli.ExpectVersion != "" {
+		if cli.ExpectVersion != version {
+			fatal(fmt.Errorf("version mismatch: launcher is %s, expected %s", version, cli.ExpectVersion))
+		}
+		os.Exit(0)
+	}
+
+	if cli.Replay != "" {
+		if rest != nil {
+			fatal(errors.New("exclusive options: -replay and shell arguments after -- cannot be used together"))
+		}
+		return loadSpec(cli.Replay)
+	}
+
+	if cli.IgnoreConfig && len(cli.ConfigPaths) > 0 {
+		fatal(errors.New("exclusive options: -ignore-config and -config cannot be used together"))
+	}
+
+	if !cli.IgnoreConfig {
+		for _, p := range cli.ConfigPaths {
+			if _, err := os.Stat(p); err != nil {
+				fatal(fmt.Errorf("%w: %w", ErrConfigNotFound, err))
+			}
+		}
+	}
+	cfg := configs.Resolve(cli, filepath.Join(filepath.Dir(execPath), "msys2_shell.json"))
+	cfg.Wd = normalizePath(cfg.Wd)
+	cfg.DotfilesDir = normalizePath(cfg.DotfilesDir)
+	cfg.HistoryFile = normalizePath(cfg.HistoryFile)
+	cfg.HistoryTemplate = normalizePath(cfg.HistoryTemplate)
+
+	if cfg.ValidateConfig {
+		problems := configProblems(cfg)
+		for _, p := range problems {
+			_, _ = fmt.Fprintln(os.Stderr, p)
+		}
+		if len(problems) > 0 {
+			fatal(fmt.Errorf("%d configuration problem(s) found", len(problems)))
+		}
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
+	if cfg.WaitForPath != "" {
+		if err := waitForPath(cfg.WaitForPath, cfg.WaitTimeout); err != nil {
+			fatal(err)
+		}
+	}
+	if len(cfg.MsysRoots) > 0 {
+		root, err := pickMsysRoot(cfg.MsysRoots)
+		if err != nil {
+			fatal(err)
+		}
+		cfg.MsysRoot = root
+	}
+	cfg.MsysRoot = normalizePath(cfg.MsysRoot)
+
+	if cfg.UseHome && cfg.Wd != "" {
+		fatal(errors.New("exclusive options: -home and -wd cannot be used together"))
+	}
+	if cfg.SaveConfigOnly && cfg.SaveConfig == "" {
+		fatal(errors.New("missing option: -save-config-only requires -save-config"))
+	}
+	if cfg.WriteEnvOnly && cfg.WriteEnv == "" {
+		fatal(errors.New("missing option: -write-env-only requires -write-env"))
+	}
+	for _, c := range cfg.Creds {
+		if name, target, ok := strings.Cut(c, "="); !ok || name == "" || target == "" {
+			fatal(fmt.Errorf("invalid credential '%s': expected NAME=TARGET", c))
+		}
+	}
+	if cfg.BufferLines < 0 || cfg.BufferLines > math.MaxInt16 {
+		fatal(fmt.Errorf("invalid buffer lines %d: must be between 1 and %d", cfg.BufferLines, math.MaxInt16))
+	}
+	for _, m := range cfg.Mounts {
+		if win, posix, ok := strings.Cut(m, "="); !ok || win == "" || !strings.HasPrefix(posix, "/") {
+			fatal(fmt.Errorf("invalid mount '%s': expected WIN=POSIX with an absolute POSIX path", m))
+		}
+	}
+	if cfg.CygdrivePrefix != "" && !strings.HasPrefix(cfg.CygdrivePrefix, "/") {
+		fatal(fmt.Errorf("invalid cygdrive prefix '%s': must be an absolute POSIX path", cfg.CygdrivePrefix))
+	}
+	if cfg.SysconfDir != "" {
+		if fi, err := os.Stat(cfg.SysconfDir); err != nil || !fi.IsDir() {
+			fatal(fmt.Errorf("sysconfdir not found: '%s'", cfg.SysconfDir))
+		}
+		if _, err := os.Stat(filepath.Join(cfg.SysconfDir, "profile")); err != nil {
+			warn(fmt.Errorf("%s has no profile; the login shell will not set up MSYS2", cfg.SysconfDir))
+		}
+	}
+	validatePathType(cfg.PathType)
+	validateLoginMode(cfg.LoginMode)
+	validateOutputEncoding(cfg.OutputEncoding)
+	if cfg.Priority != "" {
+		cfg.Priority = validatePriority(cfg.Priority)
+		if !prioritySupported {
+			fatal(errors.New("process priority is not supported on this platform"))
+		}
+	}
+	if cfg.HupOnExit && cfg.NoSignalHandling {
+		fatal(errors.New("exclusive options: -hup-on-exit and -no-signal-handling cannot be used together"))
+	}
+	if len(cfg.WrapperArgs) > 0 && cfg.Wrapper == "" {
+		fatal(errors.New("missing option: -wrapper-arg requires -wrapper"))
+	}
+	if cfg.DotfilesDir != "" {
+		if fi, err := os.Stat(cfg.DotfilesDir); err != nil || !fi.IsDir() {
+			fatal(fmt.Errorf("dotfiles directory not found: %s", cfg.DotfilesDir))
+		}
+	}
+
+	if cfg.Wd == "" && !cfg.UseHome && validateDefaultDir(cfg.DefaultDir) == "home" {
+		cfg.UseHome = true
+	}
+	if cfg.HomeWindows {
+		if !cfg.UseHome {
+			fatal(errors.New("missing option: -home-windows requires -home"))
+		}
+		if cfg.DotfilesDir != "" {
+			fatal(errors.New("exclusive options: -home-windows and -dotfiles-dir cannot be used together"))
+		}
+		profile := os.Getenv("USERPROFILE")
+		if fi, err := os.Stat(profile); profile == "" || err != nil || !fi.IsDir() {
+			fatal(fmt.Errorf("user profile directory not found: '%s'", profile))
+		}
+		cfg.Wd = profile
+	} else if cfg.UseHome {
+		cfg.Wd = msysHome(cfg.MsysRoot)
+	}
+
+	if cfg.OpenRoot || cfg.OpenHome {
+		if cfg.MsysRoot == "" {
+			fatal(errors.New("missing configuration: msysRoot not specified"))
+		}
+		dir := cfg.MsysRoot
+		if cfg.OpenHome {
+			dir = msysHome(cfg.MsysRoot)
+		}
+		// explorer.exe reports a non-zero exit code even on success, so
+		// it is not waited for.
+		if err := exec.Command("explorer.exe", dir).Start(); err != nil {
+			fatal(fmt.Errorf("open explorer failed: %w", err))
+		}
+		os.Exit(0)
+	}
+
+	if cfg.ListInstalled {
+		if cfg.MsysRoot == "" {
+			fatal(errors.New("missing configuration: msysRoot not specified"))
+		}
+		installed, err := installedMSystems(cfg.MsysRoot)
+		if err != nil {
+			fatal(err)
+		}
+		for _, m := range installed {
+			fmt.Println(m)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.ListShells {
+		if cfg.MsysRoot == "" {
+			fatal(errors.New("missing configuration: msysRoot not specified"))
+		}
+		// The MSYSTEM is optional here: without one only usr/bin is listed.
+		msystem := cmp.Or(getMSystemFromExecName(execName, cfg.ExecNameMap),
+			getMSystemFromName(cli.MSystem), getMSystemFromName(cfg.MSystem))
+		for _, sh := range installedShells(cfg.MsysRoot, msystem) {
+			fmt.Println(sh)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.KeepMsysEnv && os.Getenv("MSYSTEM") == "" {
+		cfg.KeepMsysEnv = false
+	}
+	if cfg.KeepMsysEnv && cli.MSystem == "" {
+		cfg.MSystem = resolveMSystem("", os.Getenv("MSYSTEM"), "", nil)
+	} else {
+		cfg.MSystem = resolveMSystem(execName, cli.MSystem, cfg.MSystem, cfg.ExecNameMap)
+	}
+	if cfg.KeepMsysEnv {
+		// A nested launch takes the parent shell's settings; only flags
+		// given for this launch override them.
+		if pt := os.Getenv("MSYS2_PATH_TYPE"); cli.PathType == "" && pt != "" {
+			cfg.PathType = pt
+		}
+		cfg.WinSymlinks = cli.WinSymlinks
+	}
+	if cfg.MsysRoot == "" {
+		fatal(errors.New("missing configuration: msysRoot not specified"))
+	}
+	// -probe reports a missing prefix in its result instead.
+	if !cfg.Probe {
+		if err := checkArch(cfg.MsysRoot, cfg.MSystem); err != nil {
+			fatal(err)
+		}
+	}
+	// The -env templates stay in cfg, so that -save-config and the printed
+	// command lines keep them; launcherEnv expands them for the shell.
+	expandEnvTemplates(cfg)
+
+	if cfg.LoginShell == "" {
+		cfg.LoginShell = defaultLoginShell
+		picked := false
+		if cfg.ShellFromPasswd {
+			if sh, err := shellFromPasswd(cfg.MsysRoot, os.Getenv("USERNAME")); err != nil {
+				warn(err)
+			} else {
+				cfg.LoginShell = sh
+				picked = true
+			}
+		}
+		if !picked && cfg.PickShell && isTerminal(os.Stdin) {
+			if sh := pickShell(cfg.MsysRoot); sh != "" {
+				cfg.LoginShell = sh
+			}
+		}
+	}
+
+	if rest == nil {
+		rest = []string{}
+	}
+	if err := envModuleConflict(cfg); err != nil {
+		fatal(err)
+	}
+	if cfg.Tmux != "" {
+		if len(rest) > 0 {
+			fatal(errors.New("exclusive options: -tmux and shell arguments after -- cannot be used together"))
+		}
+		tmux := filepath.Join(cfg.MsysRoot, "usr", "bin", exeName("tmux"))
+		if _, err := os.Stat(tmux); err != nil {
+			fatal(fmt.Errorf("tmux not found at %s: install it with 'pacman -S tmux'", tmux))
+		}
+		rest = []string{flagsForShell(cfg.LoginShell).Command, "tmux new -A -s " + shellQuote(cfg.Tmux)}
+	}
+	if cfg.EnvModule != "" {
+		if len(rest) > 0 {
+			fatal(errors.New("exclusive options: -env-module and shell arguments after -- cannot be used together"))
+		}
+		script, ok := cfg.EnvModules[cfg.EnvModule]
+		if !ok {
+			fatal(fmt.Errorf("unknown env module '%s'", cfg.EnvModule))
+		}
+		if _, err := os.Stat(filepath.Join(cfg.MsysRoot, filepath.FromSlash(script))); err != nil {
+			fatal(fmt.Errorf("env module script not found: %w", err))
+		}
+		// A second login shell would run /etc/profile again and reset PATH,
+		// so the module's environment is kept with an interactive shell.
+		f := flagsForShell(cfg.LoginShell)
+		rest = []string{f.Command, "source " + shellQuote(script) + "; exec " + shellQuote(cfg.LoginShell) + " " + f.Interactive}
+	}
+	if cfg.Script {
+		if cfg.Tmux != "" || cfg.NoStdin {
+			fatal(errors.New("exclusive options: -script cannot be used with -tmux or -no-stdin"))
+		}
+		// The script is sourced after the login profile, so set -e does not
+		// apply to the profile itself.
+		script := ". /dev/stdin"
+		if cfg.ErrExit {
+			script = "set -e; " + script
+		}
+		rest = append([]string{flagsForShell(cfg.LoginShell).Command, script, "stdin"}, rest...)
+	} else if cfg.ErrExit {
+		fatal(errors.New("missing option: -errexit requires -script"))
+	}
+	if cfg.AssertOutput != "" || cfg.AssertRegex != "" {
+		if cfg.AssertOutput != "" && cfg.AssertRegex != "" {
+			fatal(errors.New("exclusive options: -assert-output and -assert-regex cannot be used together"))
+		}
+		if cfg.Tmux != "" || cfg.NoStdout || cfg.RestartOnExit {
+			fatal(errors.New("exclusive options: -assert-output cannot be used with -tmux, -no-stdout or -restart-on-exit"))
+		}
+		if len(rest) == 0 {
+			fatal(errors.New("missing option: -assert-output requires a command after --"))
+		}
+		if _, err := regexp.Compile(cfg.AssertRegex); err != nil {
+			fatal(fmt.Errorf("invalid regex '%s': %w", cfg.AssertRegex, err))
+		}
+	}
+	if cfg.CaptureEnv != "" {
+		if cfg.Script || cfg.AssertOutput != "" || cfg.AssertRegex != "" || cfg.Tmux != "" || cfg.RestartOnExit {
+			fatal(errors.New("exclusive options: -capture-env cannot be used with -script, -assert-output, -tmux or -restart-on-exit"))
+		}
+		if len(rest) == 0 {
+			fatal(errors.New("missing option: -capture-env requires a command after --"))
+		}
+	}
+	return Spec{Cfg: cfg, ShellArgs: rest, Args: shellArgs, Launcher: execPath}
+}
+
+// envModuleConflict reports the options set in cfg that cannot be combined
+// with -env-module, since each of them needs the shell arguments that the
+// module replaces with its own command.
+func envModuleConflict(cfg Config) error {
+	if cfg.EnvModule == "" {
+		return nil
+	}
+	var others []string
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{cfg.Script, "-script"},
+		{cfg.Tmux != "", "-tmux"},
+		{cfg.CaptureEnv != "", "-capture-env"},
+		{cfg.AssertOutput != "", "-assert-output"},
+		{cfg.AssertRegex != "", "-assert-regex"},
+	} {
+		if o.set {
+			others = append(others, o.name)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	return fmt.Errorf("exclusive options: -env-module cannot be used with %s", strings.Join(others, ", "))
+}
+
+// executableExts are the extensions that exeName leaves alone.
+var executableExts = []string{".exe", ".com", ".bat", ".cmd"}
+
+// exeName appends exeSuffix to name unless it already has an executable
+// extension, compared case-insensitively.
+func exeName(name string) string {
+	if exeSuffix == "" || slices.Contains(executableExts, strings.ToLower(filepath.Ext(name))) {
+		return name
+	}
+	return name + exeSuffix
+}
+
+// maxCommandLine is the longest command line CreateProcess accepts, in
+// characters, excluding the terminating NUL.
+const maxCommandLine = 32766
+
+func commandLineLength(name string, args []string) int {
+	n := len(windowsQuoteArg(name))
+	for _, a := range args {
+		n += 1 + len(windowsQuoteArg(a))
+	}
+	return n
+}
+
+// argsViaScript works around the command line limit: it writes a script
+// that re-executes shellPath with args and returns a bash invocation that
+// runs it. MSYS2 programs exchange arguments between each other without
+// going through a Windows command line, so the exec inside the script is not
+// subject to the limit. The script deletes itself before the exec.
+func argsViaScript(binDir, shellPath string, args []string) (string, []string, error) {
+	f, err := os.CreateTemp("", "msys2_shell-*.sh")
+	if err != nil {
+		return "", nil, fmt.Errorf("create argument script failed: %w", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("rm -f -- \"$0\"\nexec " + shellQuote(msysPath(shellPath)))
+	for _, a := range args {
+		b.WriteString(" " + shellQuote(a))
+	}
+	b.WriteString("\n")
+
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("write argument script failed: %w", err)
+	}
+	return filepath.Join(binDir, exeName("bash")), []string{"--noprofile", "--norc", msysPath(f.Name())}, nil
+}
+
+// sessionMounts returns the mount commands for -mount, -cygdrive-prefix and
+// -sysconfdir. MSYS2's mount utility changes the mount table in memory
+// rather than the installation's fstab files, but that table is shared by
+// all MSYS2 programs of the installation running at the same time and only
+// goes away when the last of them exits.
+func sessionMounts(cfg Config) []string {
+	var cmds []string
+	if cfg.CygdrivePrefix != "" {
+		cmds = append(cmds, "/usr/bin/mount -c "+shellQuote(cfg.CygdrivePrefix))
+	}
+	for _, m := range cfg.Mounts {
+		win, posix, _ := strings.Cut(m, "=")
+		cmds = append(cmds, "/usr/bin/mount -o binary,posix=0,noacl "+shellQuote(strings.ReplaceAll(win, "\\", "/"))+" "+shellQuote(posix))
+	}
+	if cfg.SysconfDir != "" {
+		cmds = append(cmds, "/usr/bin/mount -o binary,posix=0,noacl "+shellQuote(strings.ReplaceAll(cfg.SysconfDir, "\\", "/"))+" /etc")
+	}
+	return cmds
+}
+
+// validSHA256 reports whether h is a hex-encoded SHA-256 hash.
+func validSHA256(h string) bool {
+	b, err := hex.DecodeString(h)
+	return err == nil && len(b) == sha256.Size
+}
+
+// verifySHA256 checks that the file at path has the hex-encoded SHA-256
+// hash want.
+func verifySHA256(path, want string) error {
+	if !validSHA256(want) {
+		return fmt.Errorf("invalid SHA-256 hash '%s'", want)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open shell for checksum failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("read shell for checksum failed: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, want) {
+		return fmt.Errorf("shell checksum mismatch for %s: got %s, want %s", path, got, strings.ToLower(want))
+	}
+	return nil
+}
+
+// buildCmd returns the command that starts the shell for s. It fails when
+// the programs it needs are missing or do not pass -verify-shell-sha256.
+func buildCmd(s Spec) (*exec.Cmd, error) {
+	return buildShellCmd(s, true)
+}
+
+// buildShellCmd is buildCmd; with viaScript false, a command line over the
+// Windows limit is kept as it is rather than passed through argsViaScript,
+// for callers that only print the command and never start it.
+func buildShellCmd(s Spec, viaScript bool) (*exec.Cmd, error) {
+	binDir := filepath.Join(s.Cfg.MsysRoot, "usr", "bin")
+	shellPath := filepath.Join(binDir, exeName(s.Cfg.LoginShell))
+	shellArgs := loginModeArgs(validateLoginMode(s.Cfg.LoginMode), flagsForShell(s.Cfg.LoginShell))
+
+	if s.Cfg.Restricted {
+		if exeName(strings.ToLower(s.Cfg.LoginShell)) != exeName("bash") {
+			return nil, fmt.Errorf("restricted shell requires bash as login shell, not '%s'", s.Cfg.LoginShell)
+		}
+		rbash := filepath.Join(binDir, exeName("rbash"))
+		if _, err := statWithTimeout(rbash); err == nil {
+			shellPath = rbash
+		} else {
+			// bash enables restricted mode after reading the login profile.
+			shellArgs = append(shellArgs, "-r")
+		}
+	}
+
+	shellArgs = append(shellArgs, s.Cfg.DefaultShellArgs...)
+
+	if _, err := statWithTimeout(shellPath); errors.Is(err, ErrStatTimeout) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w at %s: %w", ErrShellNotFound, shellPath, err)
+	}
+	if s.Cfg.ShellSHA256 != "" {
+		if err := verifySHA256(shellPath, s.Cfg.ShellSHA256); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := s.Cfg.Wd
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+
+	shellArgs = append(shellArgs, s.ShellArgs...)
+	if mounts := sessionMounts(s.Cfg); len(mounts) > 0 {
+		// A failing mount stops the launch with the launcher's exit code
+		// rather than starting the shell with the mount table unchanged.
+		var script strings.Builder
+		for _, m := range mounts {
+			fmt.Fprintf(&script, "%s || { echo %s >&2; exit %d; }\n", m, shellQuote("mount failed: "+m), launcherExitCode)
+		}
+		script.WriteString(`exec "$0" "$@"`)
+		shellArgs = slices.Concat([]string{"--noprofile", "--norc", "-c", script.String(), msysPath(shellPath)}, shellArgs)
+		shellPath = filepath.Join(binDir, exeName("bash"))
+	}
+	if n := commandLineLength(shellPath, shellArgs); viaScript && n > maxCommandLine {
+		warn(fmt.Errorf("command line is %d characters, over the Windows limit of %d; passing arguments through a script", n, maxCommandLine))
+		var err error
+		if shellPath, shellArgs, err = argsViaScript(binDir, shellPath, shellArgs); err != nil {
+			return nil, err
+		}
+	}
+	if s.Cfg.Wrapper != "" {
+		wrapper := s.Cfg.Wrapper
+		if !filepath.IsAbs(wrapper) {
+			wrapper = filepath.Join(binDir, exeName(wrapper))
+		}
+		if _, err := statWithTimeout(wrapper); err != nil {
+			return nil, fmt.Errorf("wrapper not found: %w", err)
+		}
+		shellArgs = slices.Concat(s.Cfg.WrapperArgs, []string{shellPath}, shellArgs)
+		shellPath = wrapper
+	}
+
+	cmd := exec.Command(shellPath, shellArgs...)
+	cmd.Dir = dir
+	cmd.Env = s.Env
+	if cmd.Env == nil {
+		env, err := applyEnv(s.Cfg)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = env
+	}
+	// A nil stream is connected to the null device by os/exec.
+	if !s.Cfg.NoStdin {
+		cmd.Stdin = os.Stdin
+	}
+	if !s.Cfg.NoStdout {
+		cmd.Stdout = os.Stdout
+	}
+	if !s.Cfg.NoStderr {
+		cmd.Stderr = os.Stderr
+	}
+	if enc := validateOutputEncoding(s.Cfg.OutputEncoding); enc != "raw" {
+		if cmd.Stdout != nil {
+			cmd.Stdout = &encodingWriter{w: cmd.Stdout, utf16: enc == "utf16"}
+		}
+		if cmd.Stderr != nil {
+			cmd.Stderr = &encodingWriter{w: cmd.Stderr, utf16: enc == "utf16"}
+		}
+	}
+
+	if s.Cfg.DropAdmin {
+		if err := dropAdmin(cmd); err != nil {
+			return nil, fmt.Errorf("drop administrator rights failed: %w", err)
+		}
+	}
+	if s.Cfg.Priority != "" {
+		if err := setPriority(cmd, s.Cfg.Priority); err != nil {
+			return nil, fmt.Errorf("set priority failed: %w", err)
+		}
+	}
+	return cmd, nil
+}
+
+// encodingWriter converts the shell's UTF-8 output for -output-encoding:
+// to valid UTF-8, or to UTF-16LE without a byte order mark. Invalid bytes
+// become U+FFFD; a character split across writes is held back until it is
+// complete.
+type encodingWriter struct {
+	w       io.Writer
+	utf16   bool
+	pending []byte
+}
+
+func (e *encodingWriter) Write(p []byte) (int, error) {
+	buf := append(e.pending, p...)
+	cut := len(buf)
+	for i := len(buf) - 1; i >= 0 && i > len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	e.pending = slices.Clone(buf[cut:])
+	if _, err := e.w.Write(e.encode(buf[:cut])); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a character left incomplete at the end of the output.
+func (e *encodingWriter) Flush() error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	_, err := e.w.Write(e.encode(e.pending))
+	e.pending = nil
+	return err
+}
+
+func (e *encodingWriter) encode(b []byte) []byte {
+	if !e.utf16 {
+		return []byte(strings.ToValidUTF8(string(b), "\uFFFD"))
+	}
+	var units []uint16
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		units = utf16.AppendRune(units, r)
+		b = b[size:]
+	}
+	out := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		out = append(out, byte(u), byte(u>>8))
+	}
+	return out
+}
+
+// progressEvent is a line printed by -progress-json.
+type progressEvent struct {
+	Event    string  `json:"event"`
+	MSystem  string  `json:"msystem"`
+	Run      int     `json:"run"`
+	Code     *int    `json:"code,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+func progress(e progressEvent) {
+	data, _ := json.Marshal(e)
+	_, _ = fmt.Fprintf(os.Stderr, "%s\n", data)
+}
+
+// analyticsRecord is a line appended to the -analytics file.
+type analyticsRecord struct {
+	Time     string `json:"time"`
+	MSystem  string `json:"msystem"`
+	PathType string `json:"pathType"`
+	Code     int    `json:"code"`
+}
+
+// recordAnalytics appends the outcome of a launch to the -analytics file,
+// if one is configured. Failures only print a warning.
+func recordAnalytics(cfg Config, code int) {
+	if cfg.Analytics == "" {
+		return
+	}
+	data, _ := json.Marshal(analyticsRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		MSystem:  cfg.MSystem,
+		PathType: validatePathType(cfg.PathType),
+		Code:     code,
+	})
+	f, err := os.OpenFile(cfg.Analytics, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		warn(fmt.Errorf("write analytics failed: %w", err))
+	}
+}
+
+// runCmd runs cmd and returns the shell's exit code. Unless
+// -no-signal-handling is set, signals are swallowed while the shell runs so
+// that Ctrl+C only reaches the shell; with -hup-on-exit, a request to
+// terminate the launcher is passed on to the shell alone as SIGHUP.
+func runCmd(cmd *exec.Cmd, cfg Config) int {
+	var sigChan chan os.Signal
+	if !cfg.NoSignalHandling {
+		sigChan = make(chan os.Signal, 1)
+		signal.Notify(sigChan)
+		defer func() {
+			signal.Stop(sigChan)
+			close(sigChan)
+		}()
+	}
+
+	if err := cmd.Start(); err != nil {
+		fatal(fmt.Errorf("shell execution failed: %w", err))
+	}
+	if cfg.Priority != "" {
+		if err := reniceShell(cmd.Process, cfg.Priority); err != nil {
+			warn(fmt.Errorf("set priority failed: %w; the shell keeps the launcher's priority", err))
+		}
+	}
+	if sigChan != nil {
+		go func() {
+			for sig := range sigChan {
+				if cfg.HupOnExit && (sig == syscall.SIGTERM || sig == syscall.SIGHUP) {
+					if err := hangUp(cmd.Process, cfg.MsysRoot); err != nil {
+						warn(fmt.Errorf("send SIGHUP to the shell failed: %w", err))
+					}
+				}
+			}
+		}()
+	}
+
+	err := cmd.Wait()
+	for _, w := range []io.Writer{cmd.Stdout, cmd.Stderr} {
+		if e, ok := w.(*encodingWriter); ok {
+			_ = e.Flush()
+		}
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			fatal(fmt.Errorf("shell execution failed: %w", err))
+		}
+		if slices.Contains(cfg.SuccessCodes, exitErr.ExitCode()) {
+			return 0
+		}
+		return exitErr.ExitCode()
+	}
+	return 0
+}
+
+// assertOutput runs the shell with its stdout captured and returns 0 if the
+// trimmed output matches -assert-output or -assert-regex, 1 otherwise. The
+// mismatch is reported with the warnings, on stderr or in the -log-file.
+func assertOutput(s Spec) int {
+	if !s.Cfg.Script {
+		s.ShellArgs = []string{flagsForShell(s.Cfg.LoginShell).Command, commandLine(s.ShellArgs)}
+	}
+	var out bytes.Buffer
+	cmd, err := buildCmd(s)
+	if err != nil {
+		fatal(err)
+	}
+	cmd.Stdout = &out
+	if code := runCmd(cmd, s.Cfg); code != 0 {
+		_, _ = fmt.Fprintf(diagOut, "assertion failed: shell exited with code %d\n", code)
+		return 1
+	}
+
+	got := strings.TrimSpace(out.String())
+	if s.Cfg.AssertRegex != "" {
+		if !regexp.MustCompile(s.Cfg.AssertRegex).MatchString(got) {
+			_, _ = fmt.Fprintf(diagOut, "assertion failed: output %q does not match %q\n", got, s.Cfg.AssertRegex)
+			return 1
+		}
+		return 0
+	}
+	if got != s.Cfg.AssertOutput {
+		_, _ = fmt.Fprintf(diagOut, "assertion failed: expected %q, got %q\n", s.Cfg.AssertOutput, got)
+		return 1
+	}
+	return 0
+}
+
+// commandLine quotes args as one shell command line. -assert-output and
+// -capture-env run the arguments after -- this way, as a command and its
+// arguments rather than as arguments to the shell.
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// captureEnvSkip lists the variables -capture-env leaves out: they describe
+// the shell process itself or hold MSYS paths that mean nothing to Windows.
+var captureEnvSkip = []string{"_", "SHLVL", "PWD", "OLDPWD", "TMP", "TEMP", "TMPDIR"}
+
+// captureEnv runs the command after -- in the shell and writes the
+// variables it leaves set differently from the launcher's environment to
+// s.Cfg.CaptureEnv, as described by capturedEnvLines. It returns the shell's
+// exit code.
+func captureEnv(s Spec) int {
+	f, err := os.CreateTemp("", "msys2_shell-env-*")
+	if err != nil {
+		fatal(fmt.Errorf("create temp file failed: %w", err))
+	}
+	_ = f.Close()
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	script := commandLine(s.ShellArgs) + "\n__status=$?\nenv -0 >" + shellQuote(msysPath(f.Name())) + "\nexit $__status\n"
+	s.ShellArgs = []string{flagsForShell(s.Cfg.LoginShell).Command, script}
+	cmd, err := buildCmd(s)
+	if err != nil {
+		fatal(err)
+	}
+	code := runCmd(cmd, s.Cfg)
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil || len(data) == 0 {
+		warn(errors.New("environment not captured: the command exited the shell before it finished"))
+		return code
+	}
+
+	lines := capturedEnvLines(s.Cfg, data, strings.EqualFold(filepath.Ext(s.Cfg.CaptureEnv), ".ps1"))
+	data = []byte(strings.Join(lines, "\r\n") + "\r\n")
+	if err := os.WriteFile(s.Cfg.CaptureEnv, data, 0o600); err != nil {
+		fatal(fmt.Errorf("write captured environment failed: %w", err))
+	}
+	return code
+}
+
+// capturedEnvLines turns the NUL-separated environment data left by the
+// -capture-env command into cmd.exe set lines or, with ps, PowerShell
+// assignments. Only variables that differ from the launcher's environment
+// are kept, other than those in captureEnvSkip and those the launcher sets
+// itself; PATH and HOME are converted to Windows paths.
+func capturedEnvLines(cfg Config, data []byte, ps bool) []string {
+	// Variables the launcher sets itself, and -cred secrets above all, are
+	// not the command's doing and are left out.
+	skip := slices.Clone(captureEnvSkip)
+	for _, kv := range launcherEnv(cfg) {
+		k, _, _ := strings.Cut(kv, "=")
+		skip = append(skip, k)
+	}
+	for _, c := range cfg.Creds {
+		k, _, _ := strings.Cut(c, "=")
+		skip = append(skip, k)
+	}
+
+	var lines []string
+	for _, kv := range strings.Split(strings.TrimRight(string(data), "\x00"), "\x00") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" || slices.ContainsFunc(skip, func(n string) bool { return envKeyEqual(n, k) }) {
+			continue
+		}
+		switch {
+		case envKeyEqual(k, "PATH"):
+			var dirs []string
+			for _, d := range strings.Split(v, ":") {
+				dirs = append(dirs, windowsPath(cfg.MsysRoot, d))
+			}
+			v = strings.Join(dirs, ";")
+		case envKeyEqual(k, "HOME"):
+			v = windowsPath(cfg.MsysRoot, v)
+		}
+		if old, ok := os.LookupEnv(k); ok && old == v {
+			continue
+		}
+		if ps {
+			lines = append(lines, "${env:"+k+"} = "+psQuote(v))
+		} else {
+			// Inside set "..." only % is special in a batch file.
+			lines = append(lines, `@set "`+k+"="+strings.ReplaceAll(v, "%", "%%")+`"`)
+		}
+	}
+	return lines
+}
+
+// capabilityInfo is the JSON printed by -capabilities.
+type capabilityInfo struct {
+	Version       string          `json:"version"`
+	Platform      string          `json:"platform"`
+	ConfigFormats []string        `json:"configFormats"`
+	MSystems      []string        `json:"msystems"`
+	Flags         []string        `json:"flags"`
+	Features      map[string]bool `json:"features"`
+}
+
+// capabilities describes this build. Features lists the platform-specific
+// options and whether they work here rather than failing with an error.
+func capabilities() capabilityInfo {
+	info := capabilityInfo{
+		Version:       version,
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		ConfigFormats: supportedConfigFormats(),
+	}
+	for _, p := range msystemPrefixes {
+		info.MSystems = append(info.MSystems, p.MSystem)
+	}
+	newLauncherFlags("", &Config{}).VisitAll(func(f *flag.Flag) {
+		info.Flags = append(info.Flags, f.Name)
+	})
+
+	windows := runtime.GOOS == "windows"
+	info.Features = map[string]bool{
+		"dropAdmin":       windows,
+		"enableLongPaths": windows,
+		"enableVT":        windows,
+		"job":             windows,
+		"openExplorer":    windows,
+		"priority":        prioritySupported,
+		"viaWT":           windows,
+	}
+	return info
+}
+
+// probeResult is the JSON printed by -probe.
+type probeResult struct {
+	MSystem string `json:"msystem"`
+	OK      bool   `json:"ok"`
+	Details string `json:"details"`
+}
+
+// probe checks that the prefix of s's MSYSTEM and the shell exist, and that
+// the shell starts and runs a trivial command with s's configuration.
+func probe(s Spec) probeResult {
+	r := probeResult{MSystem: s.Cfg.MSystem}
+	for _, p := range msystemPrefixes {
+		if p.MSystem != s.Cfg.MSystem {
+			continue
+		}
+		bin := filepath.Join(s.Cfg.MsysRoot, p.Prefix, "bin")
+		if fi, err := statWithTimeout(bin); err != nil || !fi.IsDir() {
+			r.Details = "prefix not found: " + bin
+			return r
+		}
+	}
+	shellPath := filepath.Join(s.Cfg.MsysRoot, "usr", "bin", exeName(s.Cfg.LoginShell))
+	if _, err := statWithTimeout(shellPath); errors.Is(err, ErrStatTimeout) {
+		r.Details = err.Error()
+		return r
+	} else if err != nil {
+		r.Details = "shell not found: " + shellPath
+		return r
+	}
+
+	s.ShellArgs = []string{flagsForShell(s.Cfg.LoginShell).Command, "exit 0"}
+	var stderr bytes.Buffer
+	cmd, err := buildCmd(s)
+	if err != nil {
+		r.Details = err.Error()
+		return r
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, &stderr
+	if err := cmd.Start(); err != nil {
+		r.Details = "start shell failed: " + err.Error()
+		return r
+	}
+	timer := time.AfterFunc(probeTimeout, func() { _ = cmd.Process.Kill() })
+	err = cmd.Wait()
+	if !timer.Stop() {
+		r.Details = fmt.Sprintf("shell did not finish within %s", probeTimeout)
+		return r
+	}
+	if err != nil {
+		r.Details = strings.TrimSpace("shell failed: " + err.Error() + "\n" + stderr.String())
+		return r
+	}
+	r.OK = true
+	r.Details = "shell ran " + shellPath
+	return r
+}
+
+// commandFlags are the flags that select an action or a configuration
+// source rather than describe the launch; asFlags leaves them out.
+var commandFlags = map[string]bool{
+	"as-flags": true, "capabilities": true, "config": true, "config-format": true,
+	"dump-default-config": true, "enable-long-paths": true, "expect-version": true,
+	"ignore-config": true, "list-installed": true, "list-shells": true, "open-home": true, "open-root": true,
+	"powershell-wrapper": true, "print-cmdline": true, "probe": true, "record": true, "replay": true,
+	"save-config": true, "save-config-only": true, "shortcut": true,
+	"validate-config": true, "write-env": true, "write-env-only": true,
+}
+
+// asFlags returns the flags that reproduce cfg on their own: -ignore-config
+// followed by settingFlags. The settings that only a config file can hold
+// have no flag; it warns about those that cfg uses.
+func asFlags(cfg Config, execName string) []string {
+	var lost []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{len(cfg.DefaultShellArgs) > 0, "defaultShellArgs"},
+		{len(cfg.EnvModules) > 0, "envModules"},
+		{len(cfg.ExecNameMap) > 0, "execNameMap"},
+		{len(cfg.Aliases) > 0, "aliases"},
+	} {
+		if f.set {
+			lost = append(lost, f.name)
+		}
+	}
+	if len(lost) > 0 {
+		warn(fmt.Errorf("%s from the configuration have no flags and are left out", strings.Join(lost, ", ")))
+	}
+	// With -ignore-config, only the built-in launcher names imply an MSYSTEM.
+	cfg.ExecNameMap = nil
+	return append([]string{"-ignore-config"}, settingFlags(cfg, execName)...)
+}
+
+// settingFlags returns a flag for every setting of cfg that differs from the
+// flag default. -msystem is left out when the launcher name already implies
+// it, through the built-in names or cfg.ExecNameMap.
+func settingFlags(cfg Config, execName string) []string {
+	if cfg.UseHome {
+		cfg.Wd = ""
+	}
+	if getMSystemFromExecName(execName, cfg.ExecNameMap) != "" {
+		cfg.MSystem = ""
+	}
+
+	// Registering the flags resets the fields to their defaults, so cfg is
+	// copied in afterwards for the flag values to reflect it.
+	var bound Config
+	fs := newLauncherFlags("", &bound)
+	bound = cfg
+
+	var args []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if commandFlags[f.Name] {
+			return
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			for _, v := range *list {
+				args = append(args, "-"+f.Name, v)
+			}
+			return
+		}
+		v := f.Value.String()
+		if v == f.DefValue {
+			return
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			if v == "true" {
+				args = append(args, "-"+f.Name)
+			} else {
+				args = append(args, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name, v)
+	})
+	return args
+}
+
+// launchFlags returns the flags that make the launcher reproduce cfg: the
+// configuration files of this launch, which provide the settings that have
+// no flag such as defaultShellArgs and envModules, followed by settingFlags
+// for everything else.
+func launchFlags(cfg Config, launcher string) []string {
+	var args []string
+	if cfg.IgnoreConfig {
+		args = append(args, "-ignore-config")
+	}
+	for _, p := range cfg.ConfigPaths {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		args = append(args, "-config", p)
+	}
+	if cfg.ConfigFormat != "" {
+		args = append(args, "-config-format", cfg.ConfigFormat)
+	}
+	return append(args, settingFlags(cfg, filepath.Base(launcher))...)
+}
+
+// launchArgs returns the launcher path and the arguments that repeat the
+// launch s: launchFlags and the shell arguments as given after "--".
+func launchArgs(s Spec) []string {
+	args := append([]string{s.Launcher}, launchFlags(s.Cfg, s.Launcher)...)
+	if len(s.Args) > 0 {
+		args = append(append(args, "--"), s.Args...)
+	}
+	return args
+}
+
+// printShortcut prints a Windows shortcut target and start-in directory
+// equivalent to the resolved spec.
+func printShortcut(s Spec) {
+	args := launchArgs(s)
+	for i, a := range args {
+		args[i] = windowsQuoteArg(a)
+	}
+
+	startIn := s.Cfg.Wd
+	if startIn == "" {
+		startIn, _ = os.UserHomeDir()
+	}
+	fmt.Println("Target:   " + strings.Join(args, " "))
+	fmt.Println("Start in: " + startIn)
+}
+
+// printPowerShellWrapper prints a PowerShell function named after the
+// MSYSTEM that runs the launcher with the flags printed by -shortcut. The
+// function's arguments are passed on unchanged, so further launcher flags
+// and -- followed by shell arguments can be given when calling it.
+func printPowerShellWrapper(s Spec) {
+	args := append([]string{s.Launcher}, launchFlags(s.Cfg, s.Launcher)...)
+	for i, a := range args {
+		args[i] = psQuote(a)
+	}
+	fmt.Printf("function %s {\n", strings.ToLower(s.Cfg.MSystem))
+	fmt.Printf("    & %s @args\n", strings.Join(args, " "))
+	fmt.Println("}")
+}
+
+// launchViaWT opens a new tab in the current Windows Terminal window that
+// runs the launcher with the arguments printed by -shortcut.
+func launchViaWT(s Spec) error {
+	wt, err := exec.LookPath("wt.exe")
+	if err != nil {
+		return errors.New("Windows Terminal (wt.exe) not found")
+	}
+
+	title := s.Cfg.Title
+	if title == "" {
+		title = s.Cfg.MSystem
+	}
+	args := []string{"-w", "0", "new-tab", "--title", title}
+	if s.Cfg.Wd != "" {
+		args = append(args, "-d", s.Cfg.Wd)
+	}
+	// The new tab must start the shell itself rather than open another tab.
+	s.Cfg.ViaWT = false
+	// wt.exe splits its command line into subcommands at ';'.
+	for _, a := range launchArgs(s) {
+		args = append(args, strings.ReplaceAll(a, ";", `\;`))
+	}
+
+	if err := exec.Command(wt, args...).Run(); err != nil {
+		return fmt.Errorf("start Windows Terminal failed: %w", err)
+	}
+	return nil
+}
+
+// riskyOptions lists the settings of cfg that -guard asks about.
+func riskyOptions(cfg Config) []string {
+	var risky []string
+	if strings.EqualFold(cfg.PathType, "inherit") {
+		risky = append(risky, "pathtype inherit (Windows tools may shadow MSYS2 ones)")
+	}
+	if cfg.WinSymlinks {
+		risky = append(risky, "native Windows symlinks")
+	}
+	return risky
+}
+
+// confirmLaunch asks the user to confirm a risky launch. It returns true
+// without asking when stdin is not a terminal.
+func confirmLaunch(risky []string) bool {
+	if !isTerminal(os.Stdin) {
+		return true
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "risky configuration: %s; continue? [y/N] ", strings.Join(risky, ", "))
+	in := bufio.NewScanner(os.Stdin)
+	if !in.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(in.Text()))
+	return answer == "y" || answer == "yes"
+}
+
+// diagnoseProfile re-runs the login shell with tracing enabled and prints
+// the tail of its stderr, which usually points at the failing profile line.
+func diagnoseProfile(s Spec, code int, elapsed time.Duration) {
+	const tailLines = 20
+
+	s.ShellArgs = []string{"-xc", "true"}
+	cmd, err := buildCmd(s)
+	if err != nil {
+		warn(err)
+		return
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = &stderr
+	_ = cmd.Run()
+
+	lines := strings.Split(strings.TrimRight(stderr.String(), "\n"), "\n")
+	if len(lines) > tailLines {
+		lines = lines[len(lines)-tailLines:]
+	}
+	_, _ = fmt.Fprintf(diagOut, "shell exited with code %d after %s; login profile trace:\n", code, elapsed.Round(time.Millisecond))
+	for _, l := range lines {
+		_, _ = fmt.Fprintln(diagOut, "  "+l)
+	}
+}
+
+func main() {
+	s := resolveSpec()
+	if s.Cfg.Record != "" {
+		recordSpec(s.Cfg.Record, s)
+	}
+	if s.Cfg.Shortcut {
+		printShortcut(s)
+		return
+	}
+	if s.Cfg.PrintCmdline {
+		printCmdline(s)
+		return
+	}
+	if s.Cfg.PSWrapper {
+		printPowerShellWrapper(s)
+		return
+	}
+	if s.Cfg.AsFlags {
+		args := asFlags(s.Cfg, filepath.Base(s.Launcher))
+		for i, a := range args {
+			args[i] = windowsQuoteArg(a)
+		}
+		fmt.Println(strings.Join(args, " "))
+		return
+	}
+	if s.Cfg.Probe {
+		if err := json.NewEncoder(os.Stdout).Encode(probe(s)); err != nil {
+			fatal(fmt.Errorf("encode probe result failed: %w", err))
+		}
+		return
+	}
+	if s.Cfg.SaveConfig != "" {
+		saveJSONConfig(s.Cfg.SaveConfig, s.Cfg)
+	}
+	if s.Cfg.WriteEnv != "" {
+		writeEnvFile(s.Cfg.WriteEnv, launcherEnv(s.Cfg))
+	}
+	if s.Cfg.SaveConfigOnly || s.Cfg.WriteEnvOnly {
+		return
+	}
+
+	if s.Cfg.ViaWT {
+		err := launchViaWT(s)
+		if err == nil {
+			return
+		}
+		warn(fmt.Errorf("%w; starting the shell here", err))
+	}
+
+	if isTerminal(os.Stdout) {
+		if s.Cfg.Clear {
+			_ = clearScreen()
+		}
+		// A console shared with the parent keeps its title, which is not
+		// restored when the shell exits.
+		title := s.Cfg.Title
+		if title == "" && ownsConsole() {
+			title = s.Cfg.MSystem
+		}
+		if title != "" {
+			_ = setTitle(title)
+		}
+	}
+
+	if s.Cfg.WarnMultiple {
+		if others := otherMsysRoots(s.Cfg.MsysRoot); len(others) > 0 {
+			warn(fmt.Errorf("using %s, but other MSYS2 installations exist: %s", s.Cfg.MsysRoot, strings.Join(others, ", ")))
+		}
+	}
+
+	if len(sessionMounts(s.Cfg)) > 0 {
+		if names, err := msysProcesses(s.Cfg.MsysRoot); err != nil {
+			warn(fmt.Errorf("list running MSYS2 programs failed: %w", err))
+		} else if len(names) > 0 {
+			slices.Sort(names)
+			warn(fmt.Errorf("MSYS2 programs of %s are running (%s); -mount, -cygdrive-prefix and -sysconfdir change their mounts as well", s.Cfg.MsysRoot, strings.Join(slices.Compact(names), ", ")))
+		}
+	}
+
+	if s.Cfg.MaxPathWarn > 0 {
+		dir := s.Cfg.Wd
+		if dir == "" {
+			dir, _ = os.Getwd()
+		}
+		if n := len([]rune(dir)); n > s.Cfg.MaxPathWarn {
+			if enabled, err := longPathsEnabled(); err != nil || !enabled {
+				warn(fmt.Errorf("working directory is %d characters long (over %d) and Windows long path support is off; MSYS2 tools may fail: run -enable-long-paths as administrator or use a shorter directory", n, s.Cfg.MaxPathWarn))
+			}
+		}
+	}
+	if s.Cfg.WarnPathShadowing && validatePathType(s.Cfg.PathType) == "inherit" {
+		for _, w := range pathShadowing(s.Cfg.MsysRoot) {
+			warn(errors.New(w))
+		}
+	}
+
+	if s.Cfg.HistoryTemplate != "" {
+		if err := seedHistory(s.Cfg); err != nil {
+			warn(err)
+		}
+	}
+
+	if risky := riskyOptions(s.Cfg); s.Cfg.Guard && len(risky) > 0 && !confirmLaunch(risky) {
+		fatal(errors.New("launch aborted"))
+	}
+
+	if s.Cfg.PreCommand != "" {
+		cmd := hostCommand(s.Cfg.PreCommand)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			err = fmt.Errorf("pre-command failed: %w", err)
+			if !s.Cfg.PreCommandIgnoreErrors {
+				fatal(err)
+			}
+			warn(err)
+		}
+	}
+
+	if s.Cfg.Job {
+		if err := enterJob(); err != nil {
+			fatal(fmt.Errorf("create job object failed: %w", err))
+		}
+	}
+
+	if s.Cfg.AssertOutput != "" || s.Cfg.AssertRegex != "" {
+		code := assertOutput(s)
+		recordAnalytics(s.Cfg, code)
+		os.Exit(code)
+	}
+	if s.Cfg.CaptureEnv != "" {
+		code := captureEnv(s)
+		recordAnalytics(s.Cfg, code)
+		os.Exit(code)
+	}
+
+	if s.Cfg.BufferLines > 0 {
+		if err := setBufferLines(s.Cfg.BufferLines); err != nil {
+			warn(fmt.Errorf("set console buffer size failed: %w", err))
+		}
+	}
+	restoreConsole := func() {}
+	if s.Cfg.EnableVT {
+		if restore, err := enableVT(); err != nil {
+			warn(fmt.Errorf("enable VT processing failed: %w", err))
+		} else {
+			restoreConsole = restore
+		}
+	}
+
+	var code int
+	for restarts := 0; ; restarts++ {
+		start := time.Now()
+		if s.Cfg.ProgressJSON {
+			progress(progressEvent{Event: "start", MSystem: s.Cfg.MSystem, Run: restarts + 1})
+		}
+		cmd, err := buildCmd(s)
+		if err != nil {
+			fatal(err)
+		}
+		code = runCmd(cmd, s.Cfg)
+		if s.Cfg.ProgressJSON {
+			progress(progressEvent{Event: "exit", MSystem: s.Cfg.MSystem, Run: restarts + 1,
+				Code: &code, Duration: time.Since(start).Seconds()})
+		}
+		if elapsed := time.Since(start); code != 0 && s.Cfg.ExitHook && elapsed < s.Cfg.ExitHookThreshold {
+			diagnoseProfile(s, code, elapsed)
+		}
+
+		if !s.Cfg.RestartOnExit || code == s.Cfg.RestartStopCode {
+			break
+		}
+		if s.Cfg.MaxRestarts > 0 && restarts >= s.Cfg.MaxRestarts {
+			break
+		}
+		time.Sleep(s.Cfg.RestartBackoff)
+	}
+	restoreConsole()
+	recordAnalytics(s.Cfg, code)
+	os.Exit(code)
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLauncherPaths(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = p
+	}
+
+	tests := []struct {
+		argv0    string
+		wantName string
+	}{
+		{"", filepath.Base(exe)},
+		{"ucrt64.exe", "ucrt64.exe"},
+		{filepath.Join("links", "clang64"), "clang64"},
+	}
+	for _, tt := range tests {
+		execPath, execName := launcherPaths(tt.argv0)
+		if execPath != exe {
+			t.Errorf("launcherPaths(%q) path = %q, want %q", tt.argv0, execPath, exe)
+		}
+		if execName != tt.wantName {
+			t.Errorf("launcherPaths(%q) name = %q, want %q", tt.argv0, execName, tt.wantName)
+		}
+	}
+}
+
+func TestExeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"bash", "bash" + exeSuffix},
+		{"zsh", "zsh" + exeSuffix},
+		{"bash.exe", "bash.exe"},
+		{"Bash.EXE", "Bash.EXE"},
+		{"bash.cmd", "bash.cmd"},
+		{"bash.Bat", "bash.Bat"},
+		{"tool.com", "tool.com"},
+		{"bash.sh", "bash.sh" + exeSuffix},
+	}
+	for _, tt := range tests {
+		if got := exeName(tt.name); got != tt.want {
+			t.Errorf("exeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// resolveSources resolves settings from the sources resolveSpec reads, in
+// its order: the built-in defaults, the config files with the given
+// contents, the MSYS2_SHELL_* variables in env (keyed without the prefix)
+// and the command-line flags.
+func resolveSources(t *testing.T, files []string, env map[string]string, flags []string) Config {
+	t.Helper()
+	for _, k := range []string{"LOGINSHELL", "PATHTYPE", "MSYSROOT", "WINSYMLINKS", "SHELLFROMPASSWD",
+		"SSHAUTHSOCK", "DEFAULTDIR", "MSYSTEM", "SHELLSHA256", "ANALYTICS"} {
+		t.Setenv(envConfigPrefix+k, env[k])
+	}
+
+	sources := []Config{defaultConfig()}
+	dir := t.TempDir()
+	for i, content := range files {
+		path := filepath.Join(dir, fmt.Sprintf("config%d.json", i))
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, loadConfig(path, ""))
+	}
+	sources = append(sources, loadEnvConfig())
+	cli, _, err := parseLauncherFlags("test", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolveConfig(append(sources, cli))
+}
+
+// TestResolveConfigPrecedence checks, for every setting that more than one
+// source can provide, which source wins: built-in defaults, then config
+// files in order, then MSYS2_SHELL_* variables, then flags.
+func TestResolveConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		env   map[string]string
+		flags []string
+		field func(Config) any
+		want  any
+	}{
+		{name: "pathType from defaults",
+			field: func(c Config) any { return c.PathType }, want: "minimal"},
+		{name: "pathType file beats defaults", files: []string{`{"pathType": "strict"}`},
+			field: func(c Config) any { return c.PathType }, want: "strict"},
+		{name: "pathType env beats file", files: []string{`{"pathType": "strict"}`}, env: map[string]string{"PATHTYPE": "inherit"},
+			field: func(c Config) any { return c.PathType }, want: "inherit"},
+		{name: "pathType flag beats env", files: []string{`{"pathType": "strict"}`}, env: map[string]string{"PATHTYPE": "inherit"},
+			flags: []string{"-pathtype", "minimal"},
+			field: func(c Config) any { return c.PathType }, want: "minimal"},
+
+		{name: "loginShell later file beats earlier", files: []string{`{"loginShell": "zsh"}`, `{"loginShell": "fish"}`},
+			field: func(c Config) any { return c.LoginShell }, want: "fish"},
+		{name: "loginShell file without it keeps earlier", files: []string{`{"loginShell": "zsh"}`, `{"msystem": "UCRT64"}`},
+			field: func(c Config) any { return c.LoginShell }, want: "zsh"},
+		{name: "loginShell env beats file", files: []string{`{"loginShell": "zsh"}`}, env: map[string]string{"LOGINSHELL": "fish"},
+			field: func(c Config) any { return c.LoginShell }, want: "fish"},
+		{name: "loginShell flag beats env", env: map[string]string{"LOGINSHELL": "fish"}, flags: []string{"-shell", "bash"},
+			field: func(c Config) any { return c.LoginShell }, want: "bash"},
+
+		{name: "msysRoot list from file", files: []string{`{"msysRoot": ["C:/a", "D:/b"]}`},
+			field: func(c Config) any { return [2]any{c.MsysRoot, c.MsysRoots} }, want: [2]any{"", []string{"C:/a", "D:/b"}}},
+		{name: "msysRoot later file appends with +", files: []string{`{"msysRoot": "C:/a"}`, `{"msysRoot": ["+", "D:/b"]}`},
+			field: func(c Config) any { return [2]any{c.MsysRoot, c.MsysRoots} }, want: [2]any{"", []string{"C:/a", "D:/b"}}},
+		{name: "msysRoot env replaces file list", files: []string{`{"msysRoot": ["C:/a", "D:/b"]}`}, env: map[string]string{"MSYSROOT": "E:/c"},
+			field: func(c Config) any { return [2]any{c.MsysRoot, c.MsysRoots} }, want: [2]any{"E:/c", []string(nil)}},
+		{name: "msysRoot flag beats env", env: map[string]string{"MSYSROOT": "E:/c"}, flags: []string{"-msysroot", "F:/d"},
+			field: func(c Config) any { return c.MsysRoot }, want: "F:/d"},
+
+		{name: "msystem env beats file", files: []string{`{"msystem": "UCRT64"}`}, env: map[string]string{"MSYSTEM": "CLANG64"},
+			field: func(c Config) any { return c.MSystem }, want: "CLANG64"},
+		{name: "msystem flag beats env", env: map[string]string{"MSYSTEM": "CLANG64"}, flags: []string{"-msystem", "MINGW64"},
+			field: func(c Config) any { return c.MSystem }, want: "MINGW64"},
+
+		{name: "winSymlinks from file", files: []string{`{"winSymlinks": true}`},
+			field: func(c Config) any { return c.WinSymlinks }, want: true},
+		{name: "winSymlinks env false keeps file true", files: []string{`{"winSymlinks": true}`}, env: map[string]string{"WINSYMLINKS": "false"},
+			field: func(c Config) any { return c.WinSymlinks }, want: true},
+		{name: "winSymlinks from env", env: map[string]string{"WINSYMLINKS": "1"},
+			field: func(c Config) any { return c.WinSymlinks }, want: true},
+		{name: "shellFromPasswd from env", env: map[string]string{"SHELLFROMPASSWD": "true"},
+			field: func(c Config) any { return c.ShellFromPasswd }, want: true},
+		{name: "shellFromPasswd from flag", flags: []string{"-shell-from-passwd"},
+			field: func(c Config) any { return c.ShellFromPasswd }, want: true},
+
+		{name: "sshAuthSock env beats file", files: []string{`{"sshAuthSock": "C:/a.sock"}`}, env: map[string]string{"SSHAUTHSOCK": "C:/b.sock"},
+			field: func(c Config) any { return c.SSHAuthSock }, want: "C:/b.sock"},
+		{name: "sshAuthSock flag beats env", env: map[string]string{"SSHAUTHSOCK": "C:/b.sock"}, flags: []string{"-ssh-auth-sock", "C:/c.sock"},
+			field: func(c Config) any { return c.SSHAuthSock }, want: "C:/c.sock"},
+		{name: "defaultDir env beats file", files: []string{`{"defaultDir": "home"}`}, env: map[string]string{"DEFAULTDIR": "cwd"},
+			field: func(c Config) any { return c.DefaultDir }, want: "cwd"},
+		{name: "defaultDir flag beats env", env: map[string]string{"DEFAULTDIR": "cwd"}, flags: []string{"-default-dir", "home"},
+			field: func(c Config) any { return c.DefaultDir }, want: "home"},
+		{name: "loginMode flag beats file", files: []string{`{"loginMode": "interactive"}`}, flags: []string{"-login-mode", "none"},
+			field: func(c Config) any { return c.LoginMode }, want: "none"},
+		{name: "shellSha256 env beats file", files: []string{`{"shellSha256": "aa"}`}, env: map[string]string{"SHELLSHA256": "bb"},
+			field: func(c Config) any { return c.ShellSHA256 }, want: "bb"},
+		{name: "shellSha256 flag beats env", env: map[string]string{"SHELLSHA256": "bb"}, flags: []string{"-verify-shell-sha256", "cc"},
+			field: func(c Config) any { return c.ShellSHA256 }, want: "cc"},
+		{name: "analytics env beats file", files: []string{`{"analytics": "C:/a.log"}`}, env: map[string]string{"ANALYTICS": "C:/b.log"},
+			field: func(c Config) any { return c.Analytics }, want: "C:/b.log"},
+		{name: "analytics flag beats env", env: map[string]string{"ANALYTICS": "C:/b.log"}, flags: []string{"-analytics", "C:/c.log"},
+			field: func(c Config) any { return c.Analytics }, want: "C:/c.log"},
+
+		{name: "defaultShellArgs later file replaces", files: []string{`{"defaultShellArgs": ["-a"]}`, `{"defaultShellArgs": ["-b"]}`},
+			field: func(c Config) any { return c.DefaultShellArgs }, want: []string{"-b"}},
+		{name: "defaultShellArgs later file appends with +", files: []string{`{"defaultShellArgs": ["-a"]}`, `{"defaultShellArgs": ["+", "-b"]}`},
+			field: func(c Config) any { return c.DefaultShellArgs }, want: []string{"-a", "-b"}},
+		{name: "defaultShellArgs + without earlier list", files: []string{`{"defaultShellArgs": ["+", "-b"]}`},
+			field: func(c Config) any { return c.DefaultShellArgs }, want: []string{"-b"}},
+		{name: "execNameMap later file replaces", files: []string{`{"execNameMap": {"a": "UCRT64"}}`, `{"execNameMap": {"b": "CLANG64"}}`},
+			field: func(c Config) any { return c.ExecNameMap }, want: map[string]string{"b": "CLANG64"}},
+		{name: "envModules later file replaces", files: []string{`{"envModules": {"a": "/a.sh"}}`, `{"envModules": {"b": "/b.sh"}}`},
+			field: func(c Config) any { return c.EnvModules }, want: map[string]string{"b": "/b.sh"}},
+		{name: "aliases file without them keeps earlier", files: []string{`{"aliases": {"ci": ["-script"]}}`, `{"loginShell": "zsh"}`},
+			field: func(c Config) any { return c.Aliases }, want: map[string][]string{"ci": {"-script"}}},
+		{name: "env from files and flags adds up", files: []string{`{"env": ["A=1"]}`, `{"env": ["B=2"]}`}, flags: []string{"-env", "A=3"},
+			field: func(c Config) any { return c.ExtraEnv }, want: []string{"A=1", "B=2", "A=3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.field(resolveSources(t, tt.files, tt.env, tt.flags)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestResolveConfigLists covers the fields whose sources are combined
+// rather than replaced.
+func TestResolveConfigLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []Config
+		want    Config
+	}{
+		{
+			"append marker extends earlier list",
+			[]Config{{DefaultShellArgs: []string{"a"}}, {DefaultShellArgs: []string{"+", "b"}}},
+			Config{DefaultShellArgs: []string{"a", "b"}},
+		},
+		{
+			"append marker without earlier list",
+			[]Config{{DefaultShellArgs: []string{"+", "b"}}},
+			Config{DefaultShellArgs: []string{"b"}},
+		},
+		{
+			"append marker kept across an empty source",
+			[]Config{{}, {DefaultShellArgs: []string{"+", "b"}}, {DefaultShellArgs: []string{"+", "c"}}},
+			Config{DefaultShellArgs: []string{"b", "c"}},
+		},
+		{
+			"msysRoot candidates extend a single root",
+			[]Config{{MsysRoot: "a"}, {MsysRoots: []string{"+", "b"}}},
+			Config{MsysRoots: []string{"a", "b"}},
+		},
+		{
+			"msysRoot replaces candidates",
+			[]Config{{MsysRoots: []string{"a", "b"}}, {MsysRoot: "c"}},
+			Config{MsysRoot: "c"},
+		},
+		{
+			"env adds to earlier sources",
+			[]Config{{ExtraEnv: []string{"A=1"}}, {}, {ExtraEnv: []string{"B=2", "A=3"}}},
+			Config{ExtraEnv: []string{"A=1", "B=2", "A=3"}},
+		},
+		{
+			"env ignores the append marker",
+			[]Config{{ExtraEnv: []string{"A=1"}}, {ExtraEnv: []string{"+", "B=2"}}},
+			Config{ExtraEnv: []string{"A=1", "B=2"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := resolveConfig(tt.sources); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildCmdRestricted(t *testing.T) {
+	root := t.TempDir()
+	binDir := filepath.Join(root, "usr", "bin")
+	if err := os.MkdirAll(binDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bash", "zsh"} {
+		if err := os.WriteFile(filepath.Join(binDir, exeName(name)), nil, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spec := func(shell string) Spec {
+		return Spec{Cfg: Config{MsysRoot: root, LoginShell: shell, PathType: "minimal", Restricted: true}}
+	}
+
+	if _, err := buildCmd(spec("zsh")); err == nil {
+		t.Error("buildCmd with -restricted and zsh succeeded, want an error")
+	}
+	cmd, err := buildCmd(spec("bash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cmd.Args, "-r") {
+		t.Errorf("without rbash, args = %q, want -r", cmd.Args)
+	}
+
+	rbash := filepath.Join(binDir, exeName("rbash"))
+	if err := os.WriteFile(rbash, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildCmd(spec("zsh")); err == nil {
+		t.Error("buildCmd with -restricted and zsh succeeded although rbash exists, want an error")
+	}
+	if cmd, err = buildCmd(spec("bash")); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Path != rbash {
+		t.Errorf("with rbash, path = %q, want %q", cmd.Path, rbash)
+	}
+}
+
+func TestParseLauncherFlags(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseFile string // content of the file given as @file, if any
+		args         []string
+		wantErr      bool
+		wantStray    bool
+		wantMSystem  string
+		wantShell    string
+		wantArgs     []string
+	}{
+		{name: "no arguments", args: nil},
+		{name: "flags only", args: []string{"-msystem", "UCRT64", "-shell", "zsh"},
+			wantMSystem: "UCRT64", wantShell: "zsh"},
+		{name: "shell arguments after --", args: []string{"-msystem", "UCRT64", "--", "-c", "echo hi"},
+			wantMSystem: "UCRT64", wantArgs: []string{"-c", "echo hi"}},
+		{name: "empty shell arguments after --", args: []string{"--"}, wantArgs: []string{}},
+		{name: "flags after -- belong to the shell", args: []string{"--", "-msystem", "CLANG64", "--"},
+			wantArgs: []string{"-msystem", "CLANG64", "--"}},
+		{name: "unknown flag", args: []string{"-no-such-flag"}, wantErr: true},
+		{name: "missing flag value", args: []string{"-msystem"}, wantErr: true},
+		{name: "stray positional", args: []string{"-msystem", "UCRT64", "stray"}, wantErr: true, wantStray: true},
+		{name: "stray positional before --", args: []string{"stray", "--", "-c", "true"}, wantErr: true, wantStray: true},
+		{name: "response file", responseFile: "-msystem 'CLANG64'\n-shell \"zsh\" -- -c \"echo hi\"\n",
+			args: []string{"extra"}, wantMSystem: "CLANG64", wantShell: "zsh", wantArgs: []string{"-c", "echo hi", "extra"}},
+		{name: "response file with stray positional", responseFile: "-msystem CLANG64 stray",
+			wantErr: true, wantStray: true},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.responseFile != "" {
+			path := filepath.Join(t.TempDir(), "args.rsp")
+			if err := os.WriteFile(path, []byte(tt.responseFile), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if args, err = expandResponseFile(append([]string{"@" + path}, args...)); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+
+		cfg, shellArgs, err := parseLauncherFlags("test", args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got := errors.Is(err, errUnexpectedArgs); got != tt.wantStray {
+			t.Errorf("%s: err = %v, want errUnexpectedArgs %v", tt.name, err, tt.wantStray)
+		}
+		if err != nil {
+			continue
+		}
+		if cfg.MSystem != tt.wantMSystem || cfg.LoginShell != tt.wantShell {
+			t.Errorf("%s: msystem, shell = %q, %q, want %q, %q", tt.name, cfg.MSystem, cfg.LoginShell, tt.wantMSystem, tt.wantShell)
+		}
+		if !reflect.DeepEqual(shellArgs, tt.wantArgs) {
+			t.Errorf("%s: shell args = %#v, want %#v", tt.name, shellArgs, tt.wantArgs)
+		}
+	}
+}
+
+func TestParseExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"stray argument", []string{"stray"}, 1},
+		{"stray argument with exit code", []string{"-launcher-exit-code", "125", "stray"}, 125},
+		{"unknown flag", []string{"-no-such-flag"}, 2},
+		{"unknown flag with exit code", []string{"-launcher-exit-code", "125", "-no-such-flag"}, 125},
+		{"unknown flag before exit code", []string{"-no-such-flag", "-launcher-exit-code", "125"}, 2},
+		{"out-of-range exit code", []string{"-launcher-exit-code", "300", "stray"}, 1},
+		{"help", []string{"-launcher-exit-code", "125", "-h"}, 0},
+	}
+	for _, tt := range tests {
+		cfg, _, err := parseLauncherFlags("test", tt.args)
+		if err == nil {
+			t.Errorf("%s: parseLauncherFlags succeeded, want an error", tt.name)
+			continue
+		}
+		if got := parseExitCode(err, cfg.LauncherExitCode); got != tt.want {
+			t.Errorf("%s: exit code = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCapturedEnvLines(t *testing.T) {
+	cfg := Config{
+		MSystem:  "UCRT64",
+		PathType: "minimal",
+		ExtraEnv: []string{"MSYS2_SHELL_TEST_ENV=flag"},
+		Creds:    []string{"MSYS2_SHELL_TEST_TOKEN=npm/registry"},
+	}
+	data := "MSYSTEM=UCRT64\x00CHERE_INVOKING=1\x00MSYS2_SHELL_TEST_ENV=changed\x00" +
+		"MSYS2_SHELL_TEST_TOKEN=secret\x00SHLVL=2\x00MSYS2_SHELL_TEST_NEW=50%\x00"
+
+	got := capturedEnvLines(cfg, []byte(data), false)
+	if want := []string{`@set "MSYS2_SHELL_TEST_NEW=50%%"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cmd lines = %q, want %q", got, want)
+	}
+	got = capturedEnvLines(cfg, []byte(data), true)
+	if want := []string{`${env:MSYS2_SHELL_TEST_NEW} = '50%'`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PowerShell lines = %q, want %q", got, want)
+	}
+}
+
+func TestEnvModuleConflict(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string // "" for no error
+	}{
+		{"env module alone", Config{EnvModule: "vs"}, ""},
+		{"script without env module", Config{Script: true, Tmux: "main"}, ""},
+		{"script", Config{EnvModule: "vs", Script: true}, "-script"},
+		{"tmux", Config{EnvModule: "vs", Tmux: "main"}, "-tmux"},
+		{"capture env", Config{EnvModule: "vs", CaptureEnv: "env.cmd"}, "-capture-env"},
+		{"assert output", Config{EnvModule: "vs", AssertOutput: "ok"}, "-assert-output"},
+		{"assert regex", Config{EnvModule: "vs", AssertRegex: "^ok"}, "-assert-regex"},
+		{"several", Config{EnvModule: "vs", Script: true, CaptureEnv: "env.cmd"}, "-script, -capture-env"},
+	}
+	for _, tt := range tests {
+		err := envModuleConflict(tt.cfg)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: err = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		if want := "exclusive options: -env-module cannot be used with " + tt.want; err == nil || err.Error() != want {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, want)
+		}
+	}
+}
+
+func TestEnvTemplatesKept(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "ucrt64"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	args := os.Args
+	t.Cleanup(func() { os.Args = args })
+	os.Args = []string{"msys2_shell", "-ignore-config", "-msysroot", root, "-msystem", "UCRT64", "-shell", "bash",
+		"-env", "P={{PREFIX}}/lib"}
+
+	s := resolveSpec()
+	template := []string{"P={{PREFIX}}/lib"}
+	if !reflect.DeepEqual(s.Cfg.ExtraEnv, template) {
+		t.Errorf("resolved env = %q, want %q", s.Cfg.ExtraEnv, template)
+	}
+	if env := launcherEnv(s.Cfg); !slices.Contains(env, "P=/ucrt64/lib") {
+		t.Errorf("launcher environment %q lacks P=/ucrt64/lib", env)
+	}
+
+	path := filepath.Join(t.TempDir(), "saved.json")
+	saveJSONConfig(path, s.Cfg)
+	if got := loadJSONConfig(path).ExtraEnv; !reflect.DeepEqual(got, template) {
+		t.Errorf("saved env = %q, want %q", got, template)
+	}
+}
+
+func TestAsFlagsMSystem(t *testing.T) {
+	tests := []struct {
+		name     string
+		execName string
+		nameMap  map[string]string
+		want     bool // whether -msystem is printed
+	}{
+		{"built-in name", "ucrt64.exe", nil, false},
+		{"built-in name with custom map", "ucrt64.exe", map[string]string{"dev": "CLANG64"}, false},
+		{"custom map only", "dev.exe", map[string]string{"dev": "UCRT64"}, true},
+		{"unknown name", "msys2_shell.exe", nil, true},
+	}
+	out := diagOut
+	t.Cleanup(func() { diagOut = out })
+	for _, tt := range tests {
+		var warnings bytes.Buffer
+		diagOut = &warnings
+		cfg := Config{MSystem: "UCRT64", ExecNameMap: tt.nameMap}
+		args := asFlags(cfg, tt.execName)
+		if got := strings.Contains(warnings.String(), "execNameMap"); got != (tt.nameMap != nil) {
+			t.Errorf("%s: warnings = %q, want execNameMap named %v", tt.name, warnings.String(), tt.nameMap != nil)
+		}
+		if got := slices.Contains(args, "-msystem"); got != tt.want {
+			t.Errorf("%s: asFlags = %q, want -msystem %v", tt.name, args, tt.want)
+		}
+		if args[0] != "-ignore-config" {
+			t.Errorf("%s: asFlags = %q, want -ignore-config first", tt.name, args)
+		}
+	}
+}
+
+func TestResolverResolve(t *testing.T) {
+	t.Setenv(envConfigPrefix+"LOGINSHELL", "")
+	t.Setenv("MSYS2_SHELL_TEST_SHELL", "zsh")
+	path := filepath.Join(t.TempDir(), "msys2_shell.json")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve := func(r *Resolver) string {
+		return r.Resolve(Config{}, path).LoginShell
+	}
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(`{"loginShell": "${MSYS2_SHELL_TEST_SHELL}"}`, modTime)
+	var r Resolver
+	if got := resolve(&r); got != "zsh" {
+		t.Fatalf("first resolve: loginShell = %q, want zsh", got)
+	}
+
+	// Same size and modification time: the cached document is used, but
+	// its ${VAR} references are expanded again.
+	write(`{"loginShell": "${MSYS2_SHELL_TEST_OTHER}"}`, modTime)
+	t.Setenv("MSYS2_SHELL_TEST_SHELL", "fish")
+	if got := resolve(&r); got != "fish" {
+		t.Errorf("cached resolve: loginShell = %q, want fish", got)
+	}
+
+	// A new modification time invalidates the cached document.
+	t.Setenv("MSYS2_SHELL_TEST_OTHER", "bash")
+	write(`{"loginShell": "${MSYS2_SHELL_TEST_OTHER}"}`, modTime.Add(time.Second))
+	if got := resolve(&r); got != "bash" {
+		t.Errorf("resolve after change: loginShell = %q, want bash", got)
+	}
+
+	if got := r.Resolve(Config{IgnoreConfig: true}, path).LoginShell; got != "" {
+		t.Errorf("resolve with -ignore-config: loginShell = %q, want none", got)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// msysProcesses reports no programs: outside Windows there is no MSYS2
+// runtime whose mount table the shell could share.
+func msysProcesses(string) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+
+// msysProcesses returns the names of the running programs, other than the
+// launcher, whose executables live under usr in the MSYS2 installation
+// root. They share one mount table with the shell the launcher starts.
+func msysProcesses(root string) ([]string, error) {
+	snap, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = syscall.CloseHandle(snap) }()
+
+	prefix := strings.ToLower(filepath.Join(root, "usr") + `\`)
+	self := uint32(os.Getpid())
+	var names []string
+	var e syscall.ProcessEntry32
+	e.Size = uint32(unsafe.Sizeof(e))
+	for err = syscall.Process32First(snap, &e); err == nil; err = syscall.Process32Next(snap, &e) {
+		if e.ProcessID == self {
+			continue
+		}
+		if path := processImage(e.ProcessID); strings.HasPrefix(strings.ToLower(path), prefix) {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	if err != syscall.ERROR_NO_MORE_FILES {
+		return names, err
+	}
+	return names, nil
+}
+
+// processImage returns the executable path of process pid, or "" when the
+// process cannot be queried.
+func processImage(pid uint32) string {
+	const processQueryLimitedInformation = 0x1000
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = syscall.CloseHandle(h) }()
+
+	buf := make([]uint16, 32768)
+	n := uint32(len(buf))
+	if r, _, _ := procQueryFullProcessImageNameW.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n))); r == 0 {
+		return ""
+	}
+	return syscall.UTF16ToString(buf[:n])
+}
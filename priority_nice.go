@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const prioritySupported = true
+
+var priorityNice = map[string]int{
+	"idle":   19,
+	"below":  10,
+	"normal": 0,
+	"above":  -5,
+	"high":   -10,
+}
+
+// setPriority does nothing here: the nice value can only be given to the
+// shell once it runs, by reniceShell.
+func setPriority(_ *exec.Cmd, _ string) error {
+	return nil
+}
+
+// reniceShell sets the nice value of the started shell p. Threads and
+// processes the shell creates later inherit it.
+func reniceShell(p *os.Process, level string) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, p.Pid, priorityNice[level])
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !linux && !darwin && !freebsd && !netbsd && !dragonfly
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+const prioritySupported = false
+
+func setPriority(_ *exec.Cmd, _ string) error {
+	return nil
+}
+
+func reniceShell(_ *os.Process, _ string) error {
+	return nil
+}
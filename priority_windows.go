@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const prioritySupported = true
+
+var priorityClasses = map[string]uint32{
+	"idle":   0x00000040, // IDLE_PRIORITY_CLASS
+	"below":  0x00004000, // BELOW_NORMAL_PRIORITY_CLASS
+	"normal": 0x00000020, // NORMAL_PRIORITY_CLASS
+	"above":  0x00008000, // ABOVE_NORMAL_PRIORITY_CLASS
+	"high":   0x00000080, // HIGH_PRIORITY_CLASS
+}
+
+// setPriority makes cmd start in the priority class for level.
+func setPriority(cmd *exec.Cmd, level string) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= priorityClasses[level]
+	return nil
+}
+
+// reniceShell does nothing: the shell already starts in its priority class.
+func reniceShell(_ *os.Process, _ string) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// setTitle emits the xterm title escape sequence.
+func setTitle(title string) error {
+	_, err := fmt.Fprintf(os.Stdout, "\x1b]0;%s\x07", title)
+	return err
+}
+
+// ownsConsole reports false: a terminal window belongs to the program that
+// opened it, never to the launcher.
+func ownsConsole() bool {
+	return false
+}
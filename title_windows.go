@@ -0,0 +1,31 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procSetConsoleTitleW      = kernel32.NewProc("SetConsoleTitleW")
+	procGetConsoleProcessList = kernel32.NewProc("GetConsoleProcessList")
+)
+
+func setTitle(title string) error {
+	p, err := syscall.UTF16PtrFromString(title)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procSetConsoleTitleW.Call(uintptr(unsafe.Pointer(p))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// ownsConsole reports whether the launcher is the only process attached to
+// its console, as when Windows created the console for it, e.g. when it is
+// started from Explorer or a shortcut.
+func ownsConsole() bool {
+	var pids [2]uint32
+	n, _, _ := procGetConsoleProcessList.Call(uintptr(unsafe.Pointer(&pids[0])), uintptr(len(pids)))
+	return n == 1
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func enableVT() (func(), error) {
+	return nil, errors.New("enabling VT processing is only supported on Windows")
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+
+const enableVirtualTerminalProcessing = 0x0004
+
+// enableVT turns on VT escape sequence processing for the console behind
+// stdout and returns a function restoring the previous mode.
+func enableVT() (func(), error) {
+	h := syscall.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(h, &mode); err != nil {
+		return nil, err
+	}
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode|enableVirtualTerminalProcessing)); r == 0 {
+		return nil, err
+	}
+	return func() { _, _, _ = procSetConsoleMode.Call(uintptr(h), uintptr(mode)) }, nil
+}